@@ -1,16 +1,64 @@
 package main
 
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// maxExactPairs is the largest number of pairs for which a permutation
+	// test enumerates every relabelling; above it, permutationSamples random
+	// relabellings are drawn
+	maxExactPairs      = 16
+	permutationSamples = 20000
+)
+
+// seriesEvent is an event to be placed on a minute-resolution time series.
+// A zero End marks only the start minute.
+type seriesEvent struct {
+	Start time.Time
+	End   time.Time
+	Value float64
+}
+
+// minuteSeries builds a series of n minutes starting at origin. Each event
+// sets its value on every minute from Start through End; where events
+// overlap, the largest value wins.
+func minuteSeries(events []seriesEvent, origin time.Time, n int) []float64 {
+	series := make([]float64, n)
+	for _, e := range events {
+		end := e.End
+		if end.Before(e.Start) {
+			end = e.Start
+		}
+		from := int(e.Start.Sub(origin) / time.Minute)
+		to := int(end.Sub(origin) / time.Minute)
+		if from < 0 {
+			from = 0
+		}
+		if to >= n {
+			to = n - 1
+		}
+		for i := from; i <= to; i++ {
+			if e.Value > series[i] {
+				series[i] = e.Value
+			}
+		}
+	}
+	return series
+}
+
 // lowPassFilter applies a first-order low-pass filter to a time series.
 // y[n] = alpha * x[n] + (1-alpha) * y[n-1]
 // alpha = dt / (tau + dt)
 // tau: time constant in minutes
 // dt: time resolution in minutes (here always 1)
-func lowPassFilter(series []int, tau float64) []float64 {
+func lowPassFilter(series []float64, tau float64) []float64 {
 	if tau <= 0 {
 		out := make([]float64, len(series))
-		for i, v := range series {
-			out[i] = float64(v)
-		}
+		copy(out, series)
 		return out
 	}
 	alpha := 1.0 / (tau + 1.0)
@@ -18,9 +66,9 @@ func lowPassFilter(series []int, tau float64) []float64 {
 	if len(series) == 0 {
 		return out
 	}
-	out[0] = float64(series[0])
+	out[0] = series[0]
 	for i := 1; i < len(series); i++ {
-		out[i] = alpha*float64(series[i]) + (1.0-alpha)*out[i-1]
+		out[i] = alpha*series[i] + (1.0-alpha)*out[i-1]
 	}
 	return out
 }
@@ -49,3 +97,216 @@ func crossCorrelation(x, y []float64, maxLag int) ([]int, []float64) {
 	}
 	return lags, cc
 }
+
+// latencyHistogram bins the time from each meal to the next symptom within
+// lookAhead. Both slices must be sorted in ascending order. It returns the
+// bin indices (bin i covers [i*binSize, (i+1)*binSize) minutes) over the whole
+// look-ahead, the number of meals in each bin, and the number of meals without
+// a following symptom. binSize must be positive.
+func latencyHistogram(meals, symptoms []time.Time, binSize float64, lookAhead time.Duration) ([]int, []int, int) {
+	// One bin more than whole bins fit, as a latency of exactly lookAhead
+	// starts a bin of its own
+	counts := make([]int, int(lookAhead.Minutes()/binSize)+1)
+	unmatched := 0
+	for _, m := range meals {
+		i := sort.Search(len(symptoms), func(i int) bool { return !symptoms[i].Before(m) })
+		if i == len(symptoms) || symptoms[i].Sub(m) > lookAhead {
+			unmatched++
+			continue
+		}
+		counts[int(symptoms[i].Sub(m).Minutes()/binSize)]++
+	}
+	bins := make([]int, len(counts))
+	for i := range bins {
+		bins[i] = i
+	}
+	return bins, counts, unmatched
+}
+
+// regressOut removes the linear influence of the covariate series from a
+// series by ordinary least squares with an intercept, and returns the
+// residuals. It is used to adjust for confounders such as sleep or stress
+// before cross-correlating foods with symptoms.
+func regressOut(series []float64, covariates [][]float64) []float64 {
+	k := len(covariates) + 1
+	// Build the normal equations (X'X) b = X'y, where column 0 is the intercept
+	xtx := make([][]float64, k)
+	for i := range xtx {
+		xtx[i] = make([]float64, k+1)
+	}
+	col := func(j, n int) float64 {
+		if j == 0 {
+			return 1
+		}
+		return covariates[j-1][n]
+	}
+	for n, y := range series {
+		for i := 0; i < k; i++ {
+			xi := col(i, n)
+			for j := 0; j < k; j++ {
+				xtx[i][j] += xi * col(j, n)
+			}
+			xtx[i][k] += xi * y
+		}
+	}
+	// A tiny ridge keeps the system solvable when a covariate is constant
+	for i := 1; i < k; i++ {
+		xtx[i][i] += 1e-9
+	}
+	b := solveLinear(xtx)
+	out := make([]float64, len(series))
+	for n, y := range series {
+		fit := 0.0
+		for j := 0; j < k; j++ {
+			fit += b[j] * col(j, n)
+		}
+		out[n] = y - fit
+	}
+	return out
+}
+
+// solveLinear solves the augmented k×(k+1) system by Gaussian elimination
+// with partial pivoting. Unsolvable unknowns are left at zero.
+func solveLinear(a [][]float64) []float64 {
+	k := len(a)
+	for c := 0; c < k; c++ {
+		p := c
+		for r := c + 1; r < k; r++ {
+			if math.Abs(a[r][c]) > math.Abs(a[p][c]) {
+				p = r
+			}
+		}
+		a[c], a[p] = a[p], a[c]
+		if math.Abs(a[c][c]) < 1e-12 {
+			continue
+		}
+		for r := c + 1; r < k; r++ {
+			f := a[r][c] / a[c][c]
+			for j := c; j <= k; j++ {
+				a[r][j] -= f * a[c][j]
+			}
+		}
+	}
+	x := make([]float64, k)
+	for c := k - 1; c >= 0; c-- {
+		if math.Abs(a[c][c]) < 1e-12 {
+			continue
+		}
+		sum := a[c][k]
+		for j := c + 1; j < k; j++ {
+			sum -= a[c][j] * x[j]
+		}
+		x[c] = sum / a[c][c]
+	}
+	return x
+}
+
+// pearson returns the Pearson correlation coefficient of two equally long
+// samples. It returns false if either sample has no variance.
+func pearson(x, y []float64) (float64, bool) {
+	n := float64(len(x))
+	if len(x) < 2 || len(x) != len(y) {
+		return 0, false
+	}
+	var sx, sy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+	}
+	mx, my := sx/n, sy/n
+	var cov, vx, vy float64
+	for i := range x {
+		dx, dy := x[i]-mx, y[i]-my
+		cov += dx * dy
+		vx += dx * dx
+		vy += dy * dy
+	}
+	if vx == 0 || vy == 0 {
+		return 0, false
+	}
+	return cov / math.Sqrt(vx*vy), true
+}
+
+// mean returns the arithmetic mean of a sample, or 0 if it is empty.
+func mean(x []float64) float64 {
+	if len(x) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range x {
+		sum += v
+	}
+	return sum / float64(len(x))
+}
+
+// cohensD returns the standardised mean difference between two samples,
+// (mean(a) - mean(b)) divided by their pooled standard deviation. It returns
+// false if the samples are too small or have no variance.
+func cohensD(a, b []float64) (float64, bool) {
+	if len(a) < 2 || len(b) < 2 {
+		return 0, false
+	}
+	ma, mb := mean(a), mean(b)
+	var ssa, ssb float64
+	for _, v := range a {
+		ssa += (v - ma) * (v - ma)
+	}
+	for _, v := range b {
+		ssb += (v - mb) * (v - mb)
+	}
+	pooled := math.Sqrt((ssa + ssb) / float64(len(a)+len(b)-2))
+	if pooled == 0 {
+		return 0, false
+	}
+	return (ma - mb) / pooled, true
+}
+
+// pairPermutationTest returns the two-sided p-value for the mean difference
+// between two arms that were randomised within pairs, with each pair given as
+// (first arm, second arm). Under the null hypothesis the labels within a pair
+// are exchangeable, so the test swaps them: exhaustively for up to
+// maxExactPairs pairs, and otherwise by sampling with rng.
+func pairPermutationTest(pairs [][2]float64, rng *rand.Rand) float64 {
+	if len(pairs) == 0 {
+		return 1
+	}
+	diffs := make([]float64, len(pairs))
+	observed := 0.0
+	for i, p := range pairs {
+		diffs[i] = p[0] - p[1]
+		observed += diffs[i]
+	}
+	// Allow for rounding in sums that are equal in exact arithmetic
+	threshold := math.Abs(observed) - 1e-9
+	if len(pairs) <= maxExactPairs {
+		extreme, total := 0, 1<<uint(len(pairs))
+		for mask := 0; mask < total; mask++ {
+			sum := 0.0
+			for i, d := range diffs {
+				if mask&(1<<uint(i)) != 0 {
+					d = -d
+				}
+				sum += d
+			}
+			if math.Abs(sum) >= threshold {
+				extreme++
+			}
+		}
+		return float64(extreme) / float64(total)
+	}
+	extreme := 0
+	for n := 0; n < permutationSamples; n++ {
+		sum := 0.0
+		for _, d := range diffs {
+			if rng.Intn(2) == 0 {
+				d = -d
+			}
+			sum += d
+		}
+		if math.Abs(sum) >= threshold {
+			extreme++
+		}
+	}
+	// The observed labelling counts as one of the samples
+	return float64(extreme+1) / float64(permutationSamples+1)
+}
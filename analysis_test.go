@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func closeTo(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+
+func TestRegressOut(t *testing.T) {
+	cases := []struct {
+		name       string
+		series     []float64
+		covariates [][]float64
+		want       []float64
+	}{
+		{
+			name:       "linear trend",
+			series:     []float64{3, 5, 7, 9, 11},
+			covariates: [][]float64{{0, 1, 2, 3, 4}},
+			want:       []float64{0, 0, 0, 0, 0},
+		},
+		{
+			// The noise sums to zero and is orthogonal to the trend
+			name:       "trend plus noise",
+			series:     []float64{2 + 1, 5 - 1, 8 - 1, 11 + 1},
+			covariates: [][]float64{{0, 1, 2, 3}},
+			want:       []float64{1, -1, -1, 1},
+		},
+		{
+			name:       "two covariates",
+			series:     []float64{1, 3, 0, 5, 4},
+			covariates: [][]float64{{0, 1, 0, 2, 3}, {0, 0, 1, 0, 3}},
+			want:       []float64{0, 0, 0, 0, 0},
+		},
+		{
+			// Collinear with the intercept; the ridge keeps it solvable
+			name:       "constant covariate",
+			series:     []float64{1, 2, 3, 6},
+			covariates: [][]float64{{5, 5, 5, 5}},
+			want:       []float64{-2, -1, 0, 3},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := regressOut(c.series, c.covariates)
+			if len(got) != len(c.want) {
+				t.Fatalf("got %v, want %v", got, c.want)
+			}
+			for i := range c.want {
+				if !closeTo(got[i], c.want[i]) {
+					t.Fatalf("got %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSolveLinear(t *testing.T) {
+	cases := []struct {
+		name string
+		a    [][]float64
+		want []float64
+	}{
+		{"two by two", [][]float64{{2, 1, 5}, {1, -1, 1}}, []float64{2, 1}},
+		{"needs pivoting", [][]float64{{0, 1, 3}, {1, 0, 4}}, []float64{4, 3}},
+		{"three by three", [][]float64{{1, 1, 1, 6}, {0, 2, 5, -4}, {2, 5, -1, 27}}, []float64{5, 3, -2}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := solveLinear(c.a)
+			for i := range c.want {
+				if !closeTo(got[i], c.want[i]) {
+					t.Fatalf("got %v, want %v", got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPairPermutationTest(t *testing.T) {
+	cases := []struct {
+		name  string
+		pairs [][2]float64
+		want  float64
+	}{
+		{"no pairs", nil, 1},
+		{"no differences", [][2]float64{{2, 2}, {1, 1}, {0, 0}}, 1},
+		// Only the observed signs and their mirror image reach |6|: 2/8
+		{"three consistent pairs", [][2]float64{{2, 1}, {4, 2}, {3, 0}}, 0.25},
+		{"four consistent pairs", [][2]float64{{1, 0}, {2, 0}, {3, 0}, {4, 0}}, 0.125},
+		// Sums over all signs are ±1, ±1, ±3, ±5; six of eight reach |3|
+		{"mixed signs", [][2]float64{{3, 0}, {1, 0}, {0, 1}}, 0.75},
+		// The observed sum rounds to 0.20000000000000004, its ties to 0.2
+		{"rounding", [][2]float64{{0.1, 0}, {0.2, 0}, {0, 0.1}}, 0.75},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := pairPermutationTest(c.pairs, rand.New(rand.NewSource(1)))
+			if !closeTo(got, c.want) {
+				t.Errorf("p = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPairPermutationTestSampled(t *testing.T) {
+	pairs := make([][2]float64, maxExactPairs+4)
+	for i := range pairs {
+		pairs[i] = [2]float64{1, 0}
+	}
+	// The exact p-value is 2/2^20; sampling can do no better than 1/(samples+1)
+	got := pairPermutationTest(pairs, rand.New(rand.NewSource(1)))
+	if floor := 1 / float64(permutationSamples+1); got < floor || got > 3*floor {
+		t.Errorf("p = %v, want about %v", got, floor)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Paging of list responses
+	defaultAPIPageSize = 50
+	maxAPIPageSize     = 500
+)
+
+// apiPage is a page of a list response. Total is the number of entries
+// matching the filters, across all pages.
+type apiPage struct {
+	Data   interface{} `json:"data"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// apiSymptomInput is the body of a symptom create or update request.
+type apiSymptomInput struct {
+	Description  string `json:"description"`
+	Timestamp    string `json:"timestamp"`
+	TZ           string `json:"tz"`
+	Note         string `json:"note"`
+	Severity     *int   `json:"severity"`
+	EndTimestamp string `json:"end_timestamp"`
+	Ongoing      bool   `json:"ongoing"`
+}
+
+// apiMealInput is the body of a meal create or update request.
+type apiMealInput struct {
+	Items     json.RawMessage `json:"items"`
+	Timestamp string          `json:"timestamp"`
+	TZ        string          `json:"tz"`
+	Note      string          `json:"note"`
+}
+
+// apiResourceID splits the path of a collection route into the collection
+// and an entry ID. It returns ok false for paths that match neither.
+func apiResourceID(path, prefix string) (id int64, item bool, ok bool) {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return 0, false, true
+	}
+	id, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, false, false
+	}
+	return id, true, true
+}
+
+// apiListQuery holds the filters and paging of a list request. Start and End
+// are inclusive dates in each entry's own zone, or empty.
+type apiListQuery struct {
+	Start, End    string
+	Limit, Offset int
+}
+
+// parseAPIListQuery reads the "start" and "end" date filters and the "limit"
+// and "offset" paging parameters of a list request.
+func parseAPIListQuery(r *http.Request) (apiListQuery, error) {
+	q := r.URL.Query()
+	list := apiListQuery{Limit: defaultAPIPageSize}
+	if v := q.Get("start"); v != "" {
+		if _, err := parseDateOnly(v); err != nil {
+			return list, errors.New("ugyldig startdato, bruk 2006-01-02")
+		}
+		list.Start = v
+	}
+	if v := q.Get("end"); v != "" {
+		if _, err := parseDateOnly(v); err != nil {
+			return list, errors.New("ugyldig sluttdato, bruk 2006-01-02")
+		}
+		list.End = v
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAPIPageSize {
+			return list, fmt.Errorf("limit må være mellom 1 og %d", maxAPIPageSize)
+		}
+		list.Limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return list, errors.New("ugyldig offset")
+		}
+		list.Offset = n
+	}
+	return list, nil
+}
+
+// dated reports whether the list is filtered by date. Dated lists are
+// narrowed to each entry's own date and paged in Go rather than in SQL.
+func (q apiListQuery) dated() bool {
+	return q.Start != "" || q.End != ""
+}
+
+// where returns the WHERE clause and arguments that select the entries the
+// list may hold, padded around the dates as by entryDateBounds.
+func (q apiListQuery) where() (string, []interface{}) {
+	where := "deleted_at IS NULL"
+	var args []interface{}
+	lo, hi := entryDateBounds(q.Start, q.End)
+	if q.Start != "" {
+		where += " AND timestamp >= ?"
+		args = append(args, lo)
+	}
+	if q.End != "" {
+		where += " AND timestamp < ?"
+		args = append(args, hi)
+	}
+	return where, args
+}
+
+// includes reports whether an entry falls within the list's dates in the
+// zone it was logged in.
+func (q apiListQuery) includes(t time.Time, tz string) bool {
+	date := entryDate(t, tz)
+	return (q.Start == "" || date >= q.Start) && (q.End == "" || date <= q.End)
+}
+
+// page returns the slice bounds of the requested page among n entries.
+func (q apiListQuery) page(n int) (int, int) {
+	if q.Offset >= n {
+		return n, n
+	}
+	if q.Offset+q.Limit > n {
+		return q.Offset, n
+	}
+	return q.Offset, q.Offset + q.Limit
+}
+
+// countEntries returns the number of a profile's entries in a table matching
+// a WHERE clause.
+func countEntries(profileID int64, table, where string, args ...interface{}) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE profile_id = ? AND "+where,
+		append([]interface{}{profileID}, args...)...).Scan(&n)
+	return n, err
+}
+
+// decodeAPIInput decodes a JSON request body into v.
+func decodeAPIInput(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSONError(w, "ugyldig JSON", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// writeJSONCreated writes a 201 Created response for a new entry.
+func writeJSONCreated(w http.ResponseWriter, location string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	writeJSONResponse(w, data)
+}
+
+// methodNotAllowed writes a 405 response listing the allowed methods.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeJSONError(w, "metoden er ikke støttet, bruk "+allowed, http.StatusMethodNotAllowed)
+}
+
+// apiMealsHandler serves the meals collection at /api/meals and single meals
+// at /api/meals/{id}. Deleted meals go to the trash, as from the web pages.
+func apiMealsHandler(w http.ResponseWriter, r *http.Request) {
+	id, item, ok := apiResourceID(r.URL.Path, "/api/meals")
+	if !ok {
+		writeJSONError(w, "måltid ikke funnet", http.StatusNotFound)
+		return
+	}
+	pid := currentProfileID(r)
+	switch {
+	case !item && r.Method == http.MethodGet:
+		listAPIMeals(w, r, pid)
+	case !item && r.Method == http.MethodPost:
+		var input apiMealInput
+		if !decodeAPIInput(w, r, &input) {
+			return
+		}
+		m, err := parseAPIMeal(input.Items, input.Timestamp, input.TZ, input.Note, false)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := insertMeal(pid, m)
+		if err != nil {
+			writeJSONError(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		recordRevision(pid, entityMeal, id, revCreate, channelAPI, nil)
+		m, err = apiMeal(pid, id)
+		if err != nil {
+			writeJSONError(w, "kunne ikke hente måltid", http.StatusInternalServerError)
+			return
+		}
+		writeJSONCreated(w, "/api/meals/"+strconv.FormatInt(id, 10), m)
+	case !item:
+		methodNotAllowed(w, "GET, POST")
+	case r.Method == http.MethodGet:
+		m, err := apiMeal(pid, id)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, "måltid ikke funnet", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "kunne ikke hente måltid", http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, m)
+	case r.Method == http.MethodPut:
+		before := entryBefore(pid, entityMeal, id)
+		if before == nil {
+			writeJSONError(w, "måltid ikke funnet", http.StatusNotFound)
+			return
+		}
+		var input apiMealInput
+		if !decodeAPIInput(w, r, &input) {
+			return
+		}
+		photos, err := mealPhotoFilenames(id)
+		if err != nil {
+			writeJSONError(w, "kunne ikke hente bilder", http.StatusInternalServerError)
+			return
+		}
+		m, err := parseAPIMeal(input.Items, input.Timestamp, input.TZ, input.Note, len(photos) > 0)
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.ID = int(id)
+		err = updateMeal(pid, m)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, "måltid ikke funnet", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "feil ved oppdatering", http.StatusInternalServerError)
+			return
+		}
+		recordRevision(pid, entityMeal, id, revUpdate, channelAPI, before)
+		if m, err = apiMeal(pid, id); err != nil {
+			writeJSONError(w, "kunne ikke hente måltid", http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, m)
+	case r.Method == http.MethodDelete:
+		deleteAPIEntry(w, pid, entityMeal, id, "måltid ikke funnet")
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// apiMeal returns one of a profile's meals, flagged against the elimination
+// protocols.
+func apiMeal(profileID, id int64) (Meal, error) {
+	m, err := getMeal(profileID, id)
+	if err != nil {
+		return m, err
+	}
+	meals := []Meal{m}
+	if err := flagProfileMeals(profileID, meals); err != nil {
+		return m, err
+	}
+	return meals[0], nil
+}
+
+// flagProfileMeals sets Violations on meals that break one of the profile's
+// elimination protocols.
+func flagProfileMeals(profileID int64, meals []Meal) error {
+	protocols, err := getEliminationProtocols(profileID)
+	if err != nil {
+		return err
+	}
+	return flagEliminationViolations(profileID, protocols, meals)
+}
+
+// listAPIMeals writes a page of the profile's meals, newest first.
+func listAPIMeals(w http.ResponseWriter, r *http.Request, profileID int64) {
+	list, err := parseAPIListQuery(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	where, args := list.where()
+	var meals []Meal
+	var total int
+	if list.dated() {
+		all, err := queryMeals(profileID, where+" ORDER BY timestamp DESC, id DESC", args...)
+		if err != nil {
+			writeJSONError(w, "kunne ikke hente måltider", http.StatusInternalServerError)
+			return
+		}
+		for _, m := range all {
+			if list.includes(m.Timestamp, m.TZ) {
+				meals = append(meals, m)
+			}
+		}
+		total = len(meals)
+		lo, hi := list.page(total)
+		meals = meals[lo:hi]
+	} else {
+		if total, err = countEntries(profileID, "meals", where, args...); err != nil {
+			writeJSONError(w, "kunne ikke hente måltider", http.StatusInternalServerError)
+			return
+		}
+		meals, err = queryMeals(profileID, where+" ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?", append(args, list.Limit, list.Offset)...)
+		if err != nil {
+			writeJSONError(w, "kunne ikke hente måltider", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := flagProfileMeals(profileID, meals); err != nil {
+		writeJSONError(w, "kunne ikke sjekke eliminasjonsdietten", http.StatusInternalServerError)
+		return
+	}
+	if meals == nil {
+		meals = []Meal{}
+	}
+	writeJSONResponse(w, apiPage{Data: meals, Total: total, Limit: list.Limit, Offset: list.Offset})
+}
+
+// apiSymptomsHandler serves the symptoms collection at /api/symptoms and
+// single symptoms at /api/symptoms/{id}. Deleted symptoms go to the trash,
+// as from the web pages.
+func apiSymptomsHandler(w http.ResponseWriter, r *http.Request) {
+	id, item, ok := apiResourceID(r.URL.Path, "/api/symptoms")
+	if !ok {
+		writeJSONError(w, "symptom ikke funnet", http.StatusNotFound)
+		return
+	}
+	pid := currentProfileID(r)
+	switch {
+	case !item && r.Method == http.MethodGet:
+		listAPISymptoms(w, r, pid)
+	case !item && r.Method == http.MethodPost:
+		var input apiSymptomInput
+		if !decodeAPIInput(w, r, &input) {
+			return
+		}
+		s, err := input.symptom()
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := insertSymptom(pid, s)
+		if err != nil {
+			writeJSONError(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		recordRevision(pid, entitySymptom, id, revCreate, channelAPI, nil)
+		if s, err = getSymptom(pid, id); err != nil {
+			writeJSONError(w, "kunne ikke hente symptom", http.StatusInternalServerError)
+			return
+		}
+		writeJSONCreated(w, "/api/symptoms/"+strconv.FormatInt(id, 10), s)
+	case !item:
+		methodNotAllowed(w, "GET, POST")
+	case r.Method == http.MethodGet:
+		s, err := getSymptom(pid, id)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, "symptom ikke funnet", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "kunne ikke hente symptom", http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, s)
+	case r.Method == http.MethodPut:
+		before := entryBefore(pid, entitySymptom, id)
+		if before == nil {
+			writeJSONError(w, "symptom ikke funnet", http.StatusNotFound)
+			return
+		}
+		var input apiSymptomInput
+		if !decodeAPIInput(w, r, &input) {
+			return
+		}
+		s, err := input.symptom()
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = updateSymptom(pid, id, s)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, "symptom ikke funnet", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, "feil ved oppdatering", http.StatusInternalServerError)
+			return
+		}
+		recordRevision(pid, entitySymptom, id, revUpdate, channelAPI, before)
+		if s, err = getSymptom(pid, id); err != nil {
+			writeJSONError(w, "kunne ikke hente symptom", http.StatusInternalServerError)
+			return
+		}
+		writeJSONResponse(w, s)
+	case r.Method == http.MethodDelete:
+		deleteAPIEntry(w, pid, entitySymptom, id, "symptom ikke funnet")
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
+
+// symptom validates the input and returns the symptom it describes.
+func (in apiSymptomInput) symptom() (Symptom, error) {
+	description := strings.TrimSpace(in.Description)
+	if description == "" || strings.TrimSpace(in.Timestamp) == "" {
+		return Symptom{}, errors.New("description og timestamp må oppgis")
+	}
+	severity := defaultSeverity
+	if in.Severity != nil {
+		severity = *in.Severity
+		if severity < minSeverity || severity > maxSeverity {
+			return Symptom{}, fmt.Errorf("alvorlighetsgrad må være mellom %d og %d", minSeverity, maxSeverity)
+		}
+	}
+	if _, err := loadEntryZone(in.TZ); err != nil {
+		return Symptom{}, errors.New("ugyldig tz, bruk et IANA-navn som Europe/Oslo eller en forskyvning som +02:00")
+	}
+	t, tz, err := parseEntryTime(in.Timestamp, in.TZ)
+	if err != nil {
+		return Symptom{}, errors.New("ugyldig timestamp-format, bruk 2006-01-02T15:04 eller RFC3339")
+	}
+	end, ongoing, err := parseSymptomEndValue(in.Ongoing, in.EndTimestamp, t)
+	if err != nil {
+		return Symptom{}, err
+	}
+	return Symptom{Description: description, Timestamp: t, TZ: tz, Note: in.Note, Severity: severity, EndTimestamp: end, Ongoing: ongoing}, nil
+}
+
+// listAPISymptoms writes a page of the profile's symptoms, newest first.
+func listAPISymptoms(w http.ResponseWriter, r *http.Request, profileID int64) {
+	list, err := parseAPIListQuery(r)
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	where, args := list.where()
+	var symptoms []Symptom
+	var total int
+	if list.dated() {
+		all, err := querySymptoms(profileID, where+" ORDER BY timestamp DESC, id DESC", args...)
+		if err != nil {
+			writeJSONError(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
+			return
+		}
+		for _, s := range all {
+			if list.includes(s.Timestamp, s.TZ) {
+				symptoms = append(symptoms, s)
+			}
+		}
+		total = len(symptoms)
+		lo, hi := list.page(total)
+		symptoms = symptoms[lo:hi]
+	} else {
+		if total, err = countEntries(profileID, "symptoms", where, args...); err != nil {
+			writeJSONError(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
+			return
+		}
+		symptoms, err = querySymptoms(profileID, where+" ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?", append(args, list.Limit, list.Offset)...)
+		if err != nil {
+			writeJSONError(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
+			return
+		}
+	}
+	if symptoms == nil {
+		symptoms = []Symptom{}
+	}
+	writeJSONResponse(w, apiPage{Data: symptoms, Total: total, Limit: list.Limit, Offset: list.Offset})
+}
+
+// deleteAPIEntry moves one of the profile's meals or symptoms to the trash.
+func deleteAPIEntry(w http.ResponseWriter, profileID int64, entity string, id int64, notFound string) {
+	var err error
+	if entity == entityMeal {
+		_, err = getMeal(profileID, id)
+	} else {
+		_, err = getSymptom(profileID, id)
+	}
+	if err == sql.ErrNoRows {
+		writeJSONError(w, notFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	if err := trashEntry(profileID, entity, strconv.FormatInt(id, 10), channelAPI); err != nil {
+		writeJSONError(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	writeJSONResponse(w, struct {
+		Status string `json:"status"`
+		ID     int64  `json:"id"`
+	}{"ok", id})
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// sessionCookie holds the random session token of a logged-in user
+	sessionCookie = "session"
+	// sessionDuration is how long a login lasts
+	sessionDuration = 30 * 24 * time.Hour
+
+	// PBKDF2-HMAC-SHA256 parameters for new password hashes. The iteration
+	// count is stored with each hash, so it can be raised later.
+	passwordIterations = 600000
+	passwordSaltBytes  = 16
+	passwordKeyBytes   = 32
+	passwordScheme     = "pbkdf2-sha256"
+
+	minPasswordLength = 8
+	maxUsernameLength = 64
+
+	// credentialCacheDuration is how long verified basic auth credentials
+	// are remembered, so that scripts calling the API do not pay for a
+	// password hash on every request
+	credentialCacheDuration = 5 * time.Minute
+	// Clients with maxLoginFailures failed logins within loginFailureWindow
+	// are refused until the window has passed
+	maxLoginFailures   = 10
+	loginFailureWindow = 15 * time.Minute
+)
+
+// allowSignup is set from the -allow-signup flag. Without it, only the first
+// account can be registered.
+var allowSignup bool
+
+// ownedTables are the tables with a profile_id column. Entries logged before
+// accounts existed are given to the first user that registers.
+var ownedTables = []string{"meals", "symptoms", "medications", "events", "event_kinds", "foods", "stools", "checkins", "suggestion_prefs", "meal_templates"}
+
+// User is a registered account.
+type User struct {
+	ID       int64
+	Username string
+}
+
+// Request context keys of the logged-in user and the selected profile
+type (
+	userContextKey    struct{}
+	profileContextKey struct{}
+)
+
+// currentUser returns the logged-in user of a request that has passed
+// requireLogin.
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userContextKey{}).(*User)
+	return u
+}
+
+// currentProfile returns the profile selected for a request that has passed
+// requireLogin.
+func currentProfile(r *http.Request) *Profile {
+	p, _ := r.Context().Value(profileContextKey{}).(*Profile)
+	return p
+}
+
+// currentProfileID returns the ID of the selected profile, or 0 if there is
+// none, which matches no entries.
+func currentProfileID(r *http.Request) int64 {
+	if p := currentProfile(r); p != nil {
+		return p.ID
+	}
+	return 0
+}
+
+// hashPassword returns a salted hash of the password in the form
+// "pbkdf2-sha256$iterations$salt$key", with base64 salt and key.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, passwordIterations, passwordKeyBytes, sha256.New)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash from hashPassword.
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+	got := pbkdf2.Key([]byte(password), salt, iterations, len(want), sha256.New)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+	dummyHashErr  error
+)
+
+// dummyPasswordHash returns a hash to check against when a username does not
+// exist, so that failed logins take the same time whether or not the user
+// exists. It is computed on first use, since hashing is slow by design.
+func dummyPasswordHash() (string, error) {
+	dummyHashOnce.Do(func() {
+		dummyHash, dummyHashErr = hashPassword("dummy password")
+	})
+	return dummyHash, dummyHashErr
+}
+
+// userCount returns the number of registered users.
+func userCount() (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n)
+	return n, err
+}
+
+// signupOpen reports whether new accounts can be registered.
+func signupOpen() (bool, error) {
+	if allowSignup {
+		return true, nil
+	}
+	n, err := userCount()
+	return n == 0, err
+}
+
+// validateCredentials checks a new username and password.
+func validateCredentials(username, password string) error {
+	if username == "" || len(username) > maxUsernameLength {
+		return fmt.Errorf("brukernavn må være mellom 1 og %d tegn", maxUsernameLength)
+	}
+	if strings.ContainsAny(username, ": \t") {
+		return errors.New("brukernavn kan ikke inneholde mellomrom eller kolon")
+	}
+	if len([]rune(password)) < minPasswordLength {
+		return fmt.Errorf("passordet må ha minst %d tegn", minPasswordLength)
+	}
+	return nil
+}
+
+// errUsernameTaken is returned by createUser for an existing username.
+var errUsernameTaken = errors.New("brukernavnet er opptatt")
+
+// errSignupClosed is returned by createUser when signup is not open.
+var errSignupClosed = errors.New("registrering er stengt, be administratoren starte serveren med -allow-signup")
+
+// createUser registers a new account with a profile named after the user,
+// if signup is open.
+// The first account's profile also takes over the entries logged before
+// accounts existed, before it is given the default event kinds and foods.
+func createUser(username, password string) (*User, error) {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// Without -allow-signup only the first account may be created. The check
+	// is part of the insert, so that two concurrent signups cannot both pass.
+	insert := "INSERT INTO users (username, password_hash, created_at) VALUES (?, ?, ?)"
+	if !allowSignup {
+		insert = "INSERT INTO users (username, password_hash, created_at) SELECT ?, ?, ? WHERE (SELECT COUNT(*) FROM users) = 0"
+	}
+	res, err := tx.Exec(insert, username, hash, time.Now().UTC().Format(time.RFC3339))
+	if isUniqueViolation(err) {
+		return nil, errUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if added == 0 {
+		return nil, errSignupClosed
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	profileID, err := insertProfile(tx, id, username)
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil {
+		return nil, err
+	}
+	if n == 1 {
+		for _, table := range ownedTables {
+			if _, err := tx.Exec("UPDATE "+table+" SET profile_id = ? WHERE profile_id IS NULL", profileID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := insertProfileDefaults(tx, profileID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &User{ID: id, Username: username}, nil
+}
+
+// authenticate returns the user with the given username and password, or
+// nil if they do not match.
+func authenticate(username, password string) (*User, error) {
+	var u User
+	var hash string
+	err := db.QueryRow("SELECT id, username, password_hash FROM users WHERE username = ?", username).Scan(&u.ID, &u.Username, &hash)
+	if err == sql.ErrNoRows {
+		dummy, err := dummyPasswordHash()
+		if err != nil {
+			return nil, err
+		}
+		checkPassword(dummy, password)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !checkPassword(hash, password) {
+		return nil, nil
+	}
+	return &u, nil
+}
+
+// errTooManyLogins is returned for clients with too many recent failed
+// logins.
+var errTooManyLogins = errors.New("for mange mislykkede innlogginger, prøv igjen senere")
+
+// loginFailures counts recent failed logins per client IP address.
+var loginFailures = struct {
+	sync.Mutex
+	byIP map[string]loginFailure
+}{byIP: make(map[string]loginFailure)}
+
+// loginFailure is the number of failed logins since the window started.
+type loginFailure struct {
+	count int
+	since time.Time
+}
+
+// clientIP returns the IP address a request comes from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginThrottled reports whether a client has too many recent failed logins
+// to try again yet.
+func loginThrottled(ip string) bool {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	f, ok := loginFailures.byIP[ip]
+	return ok && f.count >= maxLoginFailures && time.Since(f.since) < loginFailureWindow
+}
+
+// recordLoginFailure counts a failed login from a client. Windows that have
+// passed are cleaned up as failures come in.
+func recordLoginFailure(ip string) {
+	loginFailures.Lock()
+	defer loginFailures.Unlock()
+	now := time.Now()
+	for k, f := range loginFailures.byIP {
+		if now.Sub(f.since) >= loginFailureWindow {
+			delete(loginFailures.byIP, k)
+		}
+	}
+	f, ok := loginFailures.byIP[ip]
+	if !ok {
+		f.since = now
+	}
+	f.count++
+	loginFailures.byIP[ip] = f
+}
+
+// authenticateClient is authenticate for a request, refusing clients with
+// too many recent failed logins before the password is hashed.
+func authenticateClient(r *http.Request, username, password string) (*User, error) {
+	ip := clientIP(r)
+	if loginThrottled(ip) {
+		return nil, errTooManyLogins
+	}
+	u, err := authenticate(username, password)
+	if err == nil && u == nil {
+		recordLoginFailure(ip)
+	}
+	return u, err
+}
+
+// credentialCache holds recently verified basic auth credentials, keyed by
+// the SHA-256 of the username and password.
+var credentialCache = struct {
+	sync.Mutex
+	entries map[string]cachedCredential
+}{entries: make(map[string]cachedCredential)}
+
+// cachedCredential is a verified user and when the verification expires.
+type cachedCredential struct {
+	user    User
+	expires time.Time
+}
+
+// authenticateBasic checks basic auth credentials, hashing the password only
+// if the credentials have not been verified recently.
+func authenticateBasic(r *http.Request, username, password string) (*User, error) {
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	key := string(sum[:])
+	credentialCache.Lock()
+	c, ok := credentialCache.entries[key]
+	credentialCache.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		u := c.user
+		return &u, nil
+	}
+	u, err := authenticateClient(r, username, password)
+	if u == nil || err != nil {
+		return u, err
+	}
+	credentialCache.Lock()
+	defer credentialCache.Unlock()
+	now := time.Now()
+	for k, c := range credentialCache.entries {
+		if !now.Before(c.expires) {
+			delete(credentialCache.entries, k)
+		}
+	}
+	credentialCache.entries[key] = cachedCredential{user: *u, expires: now.Add(credentialCacheDuration)}
+	return u, nil
+}
+
+// hashToken returns the hex SHA-256 of a session token, as stored in the
+// database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession starts a session for a user and sets its cookie.
+func createSession(w http.ResponseWriter, r *http.Request, userID int64) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	expires := now.Add(sessionDuration)
+	// Expired sessions are cleaned up whenever someone logs in
+	if _, err := db.Exec("DELETE FROM sessions WHERE expires_at < ?", now.Format(time.RFC3339)); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), userID, now.Format(time.RFC3339), expires.Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// sessionUser returns the user of the request's session cookie and the
+// profile selected in the session, or nil if there is no valid session. The
+// profile ID is 0 if none has been selected.
+func sessionUser(r *http.Request) (*User, int64, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return nil, 0, nil
+	}
+	var u User
+	var profileID sql.NullInt64
+	err = db.QueryRow(`SELECT u.id, u.username, s.profile_id FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?`, hashToken(c.Value), time.Now().UTC().Format(time.RFC3339)).Scan(&u.ID, &u.Username, &profileID)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return &u, profileID.Int64, nil
+}
+
+// requestUser returns the user a request is made by and the profile selected
+// in their session. API requests may use HTTP basic authentication instead of
+// a session cookie, so that phone shortcuts can log entries.
+func requestUser(r *http.Request) (*User, int64, error) {
+	u, profileID, err := sessionUser(r)
+	if u != nil || err != nil {
+		return u, profileID, err
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		if username, password, ok := r.BasicAuth(); ok {
+			u, err := authenticateBasic(r, username, password)
+			return u, 0, err
+		}
+	}
+	return nil, 0, nil
+}
+
+// publicPath reports whether a path can be reached without logging in.
+func publicPath(path string) bool {
+	return path == "/login" || path == "/register" || strings.HasPrefix(path, "/static/")
+}
+
+// requireLogin passes requests from logged-in users on to next, with the
+// user and their selected profile in the request context. Other web requests
+// are sent to the login page, and API requests get 401 Unauthorized.
+func requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, profileID, err := requestUser(r)
+		if err == errTooManyLogins {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, "kunne ikke sjekke innlogging", http.StatusInternalServerError)
+			return
+		}
+		if u == nil {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Mat- og Symptombok", charset="UTF-8"`)
+				http.Error(w, "innlogging kreves", http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		// API requests can pick a profile by name, e.g. ?profile=Emma
+		var p *Profile
+		if name := r.URL.Query().Get("profile"); name != "" && strings.HasPrefix(r.URL.Path, "/api/") {
+			p, err = findProfileByName(u.ID, name)
+			if err == nil && p == nil {
+				http.Error(w, "ukjent profil", http.StatusBadRequest)
+				return
+			}
+		} else {
+			p, err = selectedProfile(u.ID, profileID)
+		}
+		if err != nil {
+			http.Error(w, "kunne ikke hente profil", http.StatusInternalServerError)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey{}, u)
+		ctx = context.WithValue(ctx, profileContextKey{}, p)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// safeNext returns the local path to continue to after logging in.
+func safeNext(next string) string {
+	// Only paths on this site, not "//host" or absolute URLs
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// loginPage is the data for login.html.
+type loginPage struct {
+	Register   bool
+	SignupOpen bool
+	Username   string
+	Next       string
+	Error      string
+}
+
+// renderLogin shows the login or registration form with an optional error.
+func renderLogin(w http.ResponseWriter, data loginPage, status int) {
+	w.WriteHeader(status)
+	if err := templates.ExecuteTemplate(w, "login.html", data); err != nil {
+		log.Printf("could not render login page: %v", err)
+	}
+}
+
+// loginHandler shows the login form and logs users in.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	open, err := signupOpen()
+	if err != nil {
+		http.Error(w, "kunne ikke hente brukere", http.StatusInternalServerError)
+		return
+	}
+	data := loginPage{SignupOpen: open, Next: safeNext(r.FormValue("next"))}
+	if r.Method != http.MethodPost {
+		// Send the very first visitor straight to registration
+		if n, err := userCount(); err == nil && n == 0 {
+			http.Redirect(w, r, "/register?next="+url.QueryEscape(data.Next), http.StatusSeeOther)
+			return
+		}
+		renderLogin(w, data, http.StatusOK)
+		return
+	}
+	data.Username = strings.TrimSpace(r.FormValue("username"))
+	u, err := authenticateClient(r, data.Username, r.FormValue("password"))
+	if err == errTooManyLogins {
+		data.Error = err.Error()
+		renderLogin(w, data, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "kunne ikke logge inn", http.StatusInternalServerError)
+		return
+	}
+	if u == nil {
+		data.Error = "feil brukernavn eller passord"
+		renderLogin(w, data, http.StatusUnauthorized)
+		return
+	}
+	if err := createSession(w, r, u.ID); err != nil {
+		http.Error(w, "kunne ikke logge inn", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+}
+
+// registerHandler shows the registration form and creates accounts, as long
+// as signup is open.
+func registerHandler(w http.ResponseWriter, r *http.Request) {
+	open, err := signupOpen()
+	if err != nil {
+		http.Error(w, "kunne ikke hente brukere", http.StatusInternalServerError)
+		return
+	}
+	data := loginPage{Register: true, SignupOpen: open, Next: safeNext(r.FormValue("next"))}
+	if !open {
+		data.Error = errSignupClosed.Error()
+		renderLogin(w, data, http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		renderLogin(w, data, http.StatusOK)
+		return
+	}
+	data.Username = strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+	if err := validateCredentials(data.Username, password); err != nil {
+		data.Error = err.Error()
+		renderLogin(w, data, http.StatusBadRequest)
+		return
+	}
+	if password != r.FormValue("confirm") {
+		data.Error = "passordene er ikke like"
+		renderLogin(w, data, http.StatusBadRequest)
+		return
+	}
+	u, err := createUser(data.Username, password)
+	if err == errUsernameTaken {
+		data.Error = err.Error()
+		renderLogin(w, data, http.StatusConflict)
+		return
+	}
+	if err == errSignupClosed {
+		data.Error = err.Error()
+		data.SignupOpen = false
+		renderLogin(w, data, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "feil ved registrering", http.StatusInternalServerError)
+		return
+	}
+	if err := createSession(w, r, u.ID); err != nil {
+		http.Error(w, "kunne ikke logge inn", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, data.Next, http.StatusSeeOther)
+}
+
+// logoutHandler ends the current session.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if _, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(c.Value)); err != nil {
+			http.Error(w, "feil ved utlogging", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// Check-in score scale
+	minCheckInScore     = 1
+	maxCheckInScore     = 5
+	defaultCheckInScore = 3
+
+	// defaultCheckInMaxLag is how many days back foods are compared with a
+	// check-in by default
+	defaultCheckInMaxLag = 3
+	// minCheckInDays is the least number of paired days needed to report a
+	// correlation
+	minCheckInDays = 5
+)
+
+// CheckInMetric is one of the scores in the daily check-in.
+type CheckInMetric struct {
+	Key   string
+	Label string
+}
+
+// checkInMetrics lists the check-in scores in display order. Higher is
+// better for all but stress.
+var checkInMetrics = []CheckInMetric{
+	{"wellbeing", "Velvære"},
+	{"energy", "Energi"},
+	{"mood", "Humør"},
+	{"stress", "Stress"},
+}
+
+// CheckIn is the once-per-day wellbeing check-in for a local calendar date.
+type CheckIn struct {
+	Date      string `json:"date"`
+	Wellbeing int    `json:"wellbeing"`
+	Energy    int    `json:"energy"`
+	Mood      int    `json:"mood"`
+	Stress    int    `json:"stress"`
+	Note      string `json:"note"`
+}
+
+// Score returns the value of the named metric.
+func (c CheckIn) Score(metric string) int {
+	switch metric {
+	case "wellbeing":
+		return c.Wellbeing
+	case "energy":
+		return c.Energy
+	case "mood":
+		return c.Mood
+	case "stress":
+		return c.Stress
+	}
+	return 0
+}
+
+// setScore sets the value of the named metric.
+func (c *CheckIn) setScore(metric string, v int) {
+	switch metric {
+	case "wellbeing":
+		c.Wellbeing = v
+	case "energy":
+		c.Energy = v
+	case "mood":
+		c.Mood = v
+	case "stress":
+		c.Stress = v
+	}
+}
+
+// validCheckInMetric reports whether metric is one of checkInMetrics.
+func validCheckInMetric(metric string) bool {
+	for _, m := range checkInMetrics {
+		if m.Key == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInColumns lists the columns read by scanCheckInRow, in order.
+const checkInColumns = "date, wellbeing, energy, mood, stress, note"
+
+// scanCheckInRow scans a database row into a CheckIn struct.
+func scanCheckInRow(rows rowScanner) (CheckIn, error) {
+	var c CheckIn
+	var note sql.NullString
+	err := rows.Scan(&c.Date, &c.Wellbeing, &c.Energy, &c.Mood, &c.Stress, &note)
+	c.Note = note.String
+	return c, err
+}
+
+// getCheckIn returns a profile's check-in for a date, or nil if there is none.
+func getCheckIn(profileID int64, date string) (*CheckIn, error) {
+	c, err := scanCheckInRow(db.QueryRow("SELECT "+checkInColumns+" FROM checkins WHERE profile_id = ? AND date = ?", profileID, date))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// getCheckIns returns a profile's check-ins between two dates, inclusive, keyed
+// by date. Empty bounds are open.
+func getCheckIns(profileID int64, start, end string) (map[string]CheckIn, error) {
+	if end == "" {
+		end = "9999-12-31"
+	}
+	rows, err := db.Query("SELECT "+checkInColumns+" FROM checkins WHERE profile_id = ? AND date BETWEEN ? AND ? ORDER BY date", profileID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	checkIns := make(map[string]CheckIn)
+	for rows.Next() {
+		c, err := scanCheckInRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		checkIns[c.Date] = c
+	}
+	return checkIns, rows.Err()
+}
+
+// getAllCheckIns returns all of a profile's check-ins, newest first.
+func getAllCheckIns(profileID int64) ([]CheckIn, error) {
+	byDate, err := getCheckIns(profileID, "", "")
+	if err != nil {
+		return nil, err
+	}
+	checkIns := make([]CheckIn, 0, len(byDate))
+	for _, c := range byDate {
+		checkIns = append(checkIns, c)
+	}
+	sort.Slice(checkIns, func(i, j int) bool { return checkIns[i].Date > checkIns[j].Date })
+	return checkIns, nil
+}
+
+// parseCheckInScore parses a check-in score on the fixed scale.
+func parseCheckInScore(v string) (int, error) {
+	s, err := strconv.Atoi(v)
+	if err != nil || s < minCheckInScore || s > maxCheckInScore {
+		return 0, errors.New("poengsum må være mellom 1 og 5")
+	}
+	return s, nil
+}
+
+// checkInHandler saves the check-in for a date. A second check-in on the same
+// date replaces the first.
+func checkInHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	c := CheckIn{Date: r.FormValue("date"), Note: r.FormValue("note")}
+	if _, err := parseDateOnly(c.Date); err != nil {
+		http.Error(w, "ugyldig dato", http.StatusBadRequest)
+		return
+	}
+	for _, m := range checkInMetrics {
+		score, err := parseCheckInScore(r.FormValue(m.Key))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.setScore(m.Key, score)
+	}
+	_, err := db.Exec(`INSERT INTO checkins (profile_id, date, wellbeing, energy, mood, stress, note, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(profile_id, date) DO UPDATE SET wellbeing = excluded.wellbeing, energy = excluded.energy, mood = excluded.mood,
+		stress = excluded.stress, note = excluded.note, updated_at = excluded.updated_at`,
+		currentProfileID(r), c.Date, c.Wellbeing, c.Energy, c.Mood, c.Stress, c.Note, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// CheckInCorrelation is the correlation between daily exposure to a food (or
+// food group) and a check-in score lag days later, for each lag.
+type CheckInCorrelation struct {
+	Food string     `json:"food"`
+	Lags []int      `json:"lags"`
+	R    []*float64 `json:"r"`
+	N    []int      `json:"n"`
+}
+
+// checkInCorrelationHandler correlates a daily check-in score with the number
+// of meals containing each food on the same day and the days before. Query
+// parameters: start, end, metric, maxlag (days), group and level.
+func checkInCorrelationHandler(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseLocalDateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = checkInMetrics[0].Key
+	}
+	if !validCheckInMetric(metric) {
+		http.Error(w, "ugyldig mål", http.StatusBadRequest)
+		return
+	}
+	maxLag := defaultCheckInMaxLag
+	if v := q.Get("maxlag"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 && parsed <= 14 {
+			maxLag = parsed
+		}
+	}
+	groupsOf, err := newFoodGrouper(currentProfileID(r), q.Get("group"), parseGroupLevel(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pid := currentProfileID(r)
+	checkIns, err := getCheckIns(pid, start.Format(dateFormat), end.AddDate(0, 0, -1).Format(dateFormat))
+	if err != nil {
+		http.Error(w, "kunne ikke hente innsjekkinger", http.StatusInternalServerError)
+		return
+	}
+	meals, err := getAllMeals(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente måltider", http.StatusInternalServerError)
+		return
+	}
+	// Daily exposure counts, starting maxLag days before the range so that
+	// the first check-ins can be compared with the foods before them
+	first := start.AddDate(0, 0, -maxLag)
+	dayIndex := make(map[string]int)
+	var days []string
+	for d := first; d.Before(end); d = d.AddDate(0, 0, 1) {
+		dayIndex[d.Format(dateFormat)] = len(days)
+		days = append(days, d.Format(dateFormat))
+	}
+	exposure := make(map[string][]float64)
+	for _, m := range meals {
+		i, ok := dayIndex[entryDate(m.Timestamp, m.TZ)]
+		if !ok {
+			continue
+		}
+		// Count each group once per meal, as in the report
+		seen := make(map[string]bool)
+		for _, item := range m.ItemNames() {
+			for _, group := range groupsOf(item) {
+				if seen[group] {
+					continue
+				}
+				seen[group] = true
+				if exposure[group] == nil {
+					exposure[group] = make([]float64, len(days))
+				}
+				exposure[group][i]++
+			}
+		}
+	}
+
+	results := []CheckInCorrelation{}
+	for food, counts := range exposure {
+		res := CheckInCorrelation{Food: food}
+		for lag := 0; lag <= maxLag; lag++ {
+			var x, y []float64
+			for i := maxLag; i < len(days); i++ {
+				c, ok := checkIns[days[i]]
+				if !ok {
+					continue
+				}
+				x = append(x, counts[i-lag])
+				y = append(y, float64(c.Score(metric)))
+			}
+			res.Lags = append(res.Lags, lag)
+			res.N = append(res.N, len(x))
+			if rho, ok := pearson(x, y); ok && len(x) >= minCheckInDays {
+				res.R = append(res.R, &rho)
+			} else {
+				res.R = append(res.R, nil)
+			}
+		}
+		results = append(results, res)
+	}
+	// Strongest correlations first
+	strength := func(c CheckInCorrelation) float64 {
+		best := -1.0
+		for _, r := range c.R {
+			if r != nil && math.Abs(*r) > best {
+				best = math.Abs(*r)
+			}
+		}
+		return best
+	}
+	sort.Slice(results, func(i, j int) bool {
+		si, sj := strength(results[i]), strength(results[j])
+		if si != sj {
+			return si > sj
+		}
+		return results[i].Food < results[j].Food
+	})
+
+	if err := writeJSONResponse(w, results); err != nil {
+		http.Error(w, "feil ved encoding av JSON", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Limits for the elimination protocol form
+	maxEliminationWeeks = 52
+	maxChallengeDays    = 14
+	// defaultChallengeDays is the default length of a reintroduction window:
+	// the challenge day followed by days of watching for a reaction
+	defaultChallengeDays = 3
+
+	// eliminationBaselineDays is how many of the last days of the
+	// elimination phase symptoms are compared against
+	eliminationBaselineDays = 7
+	// A challenge is flagged as a possible reaction when it is followed by at
+	// least minReactionSymptoms symptoms, and either reactionRateRatio times
+	// the baseline symptoms per day or a mean severity reactionSeverityRise
+	// above the baseline
+	minReactionSymptoms  = 2
+	reactionRateRatio    = 1.5
+	reactionSeverityRise = 2.0
+)
+
+// Phases of an elimination protocol.
+const (
+	phaseUpcoming       = "upcoming"
+	phaseElimination    = "elimination"
+	phaseReintroduction = "reintroduction"
+	phaseDone           = "done"
+)
+
+// EliminationProtocol is an elimination diet: Foods are left out for
+// EliminationWeeks from StartDate and then reintroduced one at a time, in
+// order, each with a window of ChallengeDays days. Foods stay out until
+// their own challenge, and again after it, so that every challenge is judged
+// on its own.
+type EliminationProtocol struct {
+	ID               int64    `json:"id"`
+	Name             string   `json:"name"`
+	StartDate        string   `json:"start_date"`
+	EliminationWeeks int      `json:"elimination_weeks"`
+	ChallengeDays    int      `json:"challenge_days"`
+	Foods            []string `json:"foods"`
+}
+
+// EliminationPhase is where a protocol stands on a given date. Day counts
+// from 1 within the phase, which lasts Days days. Food is set while it is
+// being reintroduced.
+type EliminationPhase struct {
+	Kind string
+	Food string
+	Day  int
+	Days int
+}
+
+// Label describes the phase for display.
+func (p EliminationPhase) Label() string {
+	switch p.Kind {
+	case phaseUpcoming:
+		return "⏳ Ikke startet"
+	case phaseElimination:
+		return "🚫 Eliminering, dag " + strconv.Itoa(p.Day) + " av " + strconv.Itoa(p.Days)
+	case phaseReintroduction:
+		return "🧪 Reintroduksjon av " + p.Food + ", dag " + strconv.Itoa(p.Day) + " av " + strconv.Itoa(p.Days)
+	}
+	return "✅ Fullført"
+}
+
+// EliminationChallenge is the reintroduction window of one food, between
+// two local dates inclusive.
+type EliminationChallenge struct {
+	Food  string
+	Start string
+	End   string
+}
+
+// addDays returns the local date n days after date.
+func addDays(date string, n int) string {
+	t, err := parseDateOnly(date)
+	if err != nil {
+		return date
+	}
+	return t.AddDate(0, 0, n).Format(dateFormat)
+}
+
+// daysBetween returns the number of days from one local date to another.
+func daysBetween(from, to string) int {
+	a, errA := parseDateOnly(from)
+	b, errB := parseDateOnly(to)
+	if errA != nil || errB != nil {
+		return 0
+	}
+	return int(b.Sub(a).Hours() / 24)
+}
+
+// ReintroductionStart returns the first date after the elimination phase.
+func (p EliminationProtocol) ReintroductionStart() string {
+	return addDays(p.StartDate, p.EliminationWeeks*7)
+}
+
+// EndDate returns the last date of the protocol.
+func (p EliminationProtocol) EndDate() string {
+	return addDays(p.ReintroductionStart(), len(p.Foods)*p.ChallengeDays-1)
+}
+
+// Challenges returns the reintroduction windows in order.
+func (p EliminationProtocol) Challenges() []EliminationChallenge {
+	start := p.ReintroductionStart()
+	challenges := make([]EliminationChallenge, len(p.Foods))
+	for i, food := range p.Foods {
+		from := addDays(start, i*p.ChallengeDays)
+		challenges[i] = EliminationChallenge{Food: food, Start: from, End: addDays(from, p.ChallengeDays-1)}
+	}
+	return challenges
+}
+
+// PhaseOn returns the phase of the protocol on a local date.
+func (p EliminationProtocol) PhaseOn(date string) EliminationPhase {
+	if date < p.StartDate {
+		return EliminationPhase{Kind: phaseUpcoming}
+	}
+	if date < p.ReintroductionStart() {
+		return EliminationPhase{Kind: phaseElimination, Day: daysBetween(p.StartDate, date) + 1, Days: p.EliminationWeeks * 7}
+	}
+	for _, c := range p.Challenges() {
+		if date <= c.End {
+			return EliminationPhase{Kind: phaseReintroduction, Food: c.Food, Day: daysBetween(c.Start, date) + 1, Days: p.ChallengeDays}
+		}
+	}
+	return EliminationPhase{Kind: phaseDone}
+}
+
+// Current returns the phase of the protocol today.
+func (p EliminationProtocol) Current() EliminationPhase {
+	return p.PhaseOn(time.Now().Format(dateFormat))
+}
+
+// excludedOn returns the foods that must be left out on a local date. Only
+// the food being reintroduced is allowed during its window.
+func (p EliminationProtocol) excludedOn(date string) []string {
+	phase := p.PhaseOn(date)
+	if phase.Kind != phaseElimination && phase.Kind != phaseReintroduction {
+		return nil
+	}
+	var excluded []string
+	for _, food := range p.Foods {
+		if !strings.EqualFold(food, phase.Food) {
+			excluded = append(excluded, food)
+		}
+	}
+	return excluded
+}
+
+// ExcludedToday returns the foods to leave out today.
+func (p EliminationProtocol) ExcludedToday() []string {
+	return p.excludedOn(time.Now().Format(dateFormat))
+}
+
+// violations returns the items of a meal that break the protocol on the
+// meal's local date. An item breaks it if it is an excluded food or lies
+// below one in the food catalog.
+func (p EliminationProtocol) violations(m Meal, group foodGrouper) []string {
+	excluded := p.excludedOn(m.Timestamp.Format(dateFormat))
+	if len(excluded) == 0 {
+		return nil
+	}
+	var out []string
+	for _, item := range m.Items {
+		if containsFood(excluded, group(item.Name)) {
+			out = append(out, item.Name)
+		}
+	}
+	return out
+}
+
+// containsFood reports whether any of names is one of foods, ignoring case.
+func containsFood(foods, names []string) bool {
+	for _, food := range foods {
+		for _, name := range names {
+			if strings.EqualFold(food, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getEliminationProtocols returns a profile's protocols with their foods,
+// latest start first.
+func getEliminationProtocols(profileID int64) ([]EliminationProtocol, error) {
+	rows, err := db.Query(`SELECT id, name, start_date, elimination_weeks, challenge_days FROM elimination_protocols
+		WHERE profile_id = ? ORDER BY start_date DESC, id DESC`, profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var protocols []EliminationProtocol
+	byID := make(map[int64]int)
+	for rows.Next() {
+		var p EliminationProtocol
+		if err := rows.Scan(&p.ID, &p.Name, &p.StartDate, &p.EliminationWeeks, &p.ChallengeDays); err != nil {
+			return nil, err
+		}
+		byID[p.ID] = len(protocols)
+		protocols = append(protocols, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	foodRows, err := db.Query(`SELECT f.protocol_id, f.name FROM elimination_foods f
+		JOIN elimination_protocols p ON p.id = f.protocol_id WHERE p.profile_id = ? ORDER BY f.protocol_id, f.position`, profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer foodRows.Close()
+	for foodRows.Next() {
+		var id int64
+		var name string
+		if err := foodRows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		if i, ok := byID[id]; ok {
+			protocols[i].Foods = append(protocols[i].Foods, name)
+		}
+	}
+	return protocols, foodRows.Err()
+}
+
+// activeProtocol returns the protocol that covers a local date, preferring
+// the one started last, or nil if there is none.
+func activeProtocol(protocols []EliminationProtocol, date string) *EliminationProtocol {
+	for i, p := range protocols {
+		if p.StartDate <= date && date <= p.EndDate() {
+			return &protocols[i]
+		}
+	}
+	return nil
+}
+
+// flagEliminationViolations sets Violations on a profile's meals that break
+// the protocol active on their date.
+func flagEliminationViolations(profileID int64, protocols []EliminationProtocol, meals []Meal) error {
+	if len(protocols) == 0 {
+		return nil
+	}
+	foods, err := getAllFoods(profileID)
+	if err != nil {
+		return err
+	}
+	group := treeGrouper(newFoodTree(foods), -1)
+	for i, m := range meals {
+		if p := activeProtocol(protocols, m.Timestamp.Format(dateFormat)); p != nil {
+			meals[i].Violations = p.violations(m, group)
+		}
+	}
+	return nil
+}
+
+// saveEliminationProtocol stores a new protocol for a profile.
+func saveEliminationProtocol(profileID int64, p EliminationProtocol) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO elimination_protocols (profile_id, name, start_date, elimination_weeks, challenge_days, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, profileID, p.Name, p.StartDate, p.EliminationWeeks, p.ChallengeDays, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i, food := range p.Foods {
+		if _, err := tx.Exec("INSERT INTO elimination_foods (protocol_id, name, position) VALUES (?, ?, ?)", id, food, i); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// parseEliminationForm reads a protocol from the form. Foods are given one
+// per line or separated by commas, in reintroduction order.
+func parseEliminationForm(r *http.Request) (EliminationProtocol, error) {
+	p := EliminationProtocol{Name: strings.TrimSpace(r.FormValue("name")), StartDate: r.FormValue("start_date")}
+	if p.Name == "" {
+		return p, errors.New("navn må oppgis")
+	}
+	if _, err := parseDateOnly(p.StartDate); err != nil {
+		return p, errors.New("ugyldig startdato")
+	}
+	var err error
+	p.EliminationWeeks, err = strconv.Atoi(r.FormValue("elimination_weeks"))
+	if err != nil || p.EliminationWeeks < 1 || p.EliminationWeeks > maxEliminationWeeks {
+		return p, errors.New("antall uker må være mellom 1 og 52")
+	}
+	p.ChallengeDays, err = strconv.Atoi(r.FormValue("challenge_days"))
+	if err != nil || p.ChallengeDays < 1 || p.ChallengeDays > maxChallengeDays {
+		return p, errors.New("dager per reintroduksjon må være mellom 1 og 14")
+	}
+	fields := strings.FieldsFunc(r.FormValue("foods"), func(c rune) bool { return c == '\n' || c == ',' })
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		if f != "" && !containsFood(p.Foods, []string{f}) {
+			p.Foods = append(p.Foods, f)
+		}
+	}
+	if len(p.Foods) == 0 {
+		return p, errors.New("minst én matvare må oppgis")
+	}
+	return p, nil
+}
+
+// ChallengeResult summarises the symptoms logged in a reintroduction window
+// against the baseline at the end of the elimination phase.
+type ChallengeResult struct {
+	EliminationChallenge
+	// Status is "planned", "ongoing" or "done"
+	Status string
+	// Eaten is true if the food was logged during the window
+	Eaten          bool
+	Symptoms       int
+	SymptomsPerDay float64
+	MeanSeverity   float64
+	MaxSeverity    int
+	// SymptomTypes are the symptoms logged in the window, most frequent first
+	SymptomTypes []string
+	Reaction     bool
+}
+
+// Verdict describes the result for display.
+func (c ChallengeResult) Verdict() string {
+	switch {
+	case c.Status == "planned":
+		return "⏳ Planlagt"
+	case !c.Eaten:
+		return "❔ Ikke logget spist"
+	case c.Reaction:
+		return "⚠️ Mulig reaksjon"
+	case c.Status == "ongoing":
+		return "🧪 Pågår"
+	}
+	return "✅ Ingen tydelig reaksjon"
+}
+
+// EliminationBaseline is the symptom level over the last days of the
+// elimination phase.
+type EliminationBaseline struct {
+	Start          string
+	End            string
+	Symptoms       int
+	SymptomsPerDay float64
+	MeanSeverity   float64
+}
+
+// EliminationReport is a protocol with its current phase, reintroduction
+// results and the meals that broke it.
+type EliminationReport struct {
+	EliminationProtocol
+	Phase      EliminationPhase
+	Baseline   EliminationBaseline
+	Results    []ChallengeResult
+	Violations []Meal
+}
+
+// symptomStats returns the number of symptoms, their mean and highest
+// severity, and their descriptions by frequency.
+func symptomStats(symptoms []Symptom) (int, float64, int, []string) {
+	if len(symptoms) == 0 {
+		return 0, 0, 0, nil
+	}
+	total, highest := 0, 0
+	counts := make(map[string]int)
+	var types []string
+	for _, s := range symptoms {
+		total += s.Severity
+		if s.Severity > highest {
+			highest = s.Severity
+		}
+		if counts[s.Description] == 0 {
+			types = append(types, s.Description)
+		}
+		counts[s.Description]++
+	}
+	sort.SliceStable(types, func(i, j int) bool { return counts[types[i]] > counts[types[j]] })
+	return len(symptoms), float64(total) / float64(len(symptoms)), highest, types
+}
+
+// symptomsBetween returns the symptoms logged between two local dates
+// inclusive.
+func symptomsBetween(symptoms []Symptom, start, end string) []Symptom {
+	var out []Symptom
+	for _, s := range symptoms {
+		if d := s.Timestamp.Format(dateFormat); start <= d && d <= end {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// eliminationReport evaluates a protocol from a profile's meals and symptoms
+// up to today.
+func eliminationReport(profileID int64, p EliminationProtocol, group foodGrouper) (EliminationReport, error) {
+	rep := EliminationReport{EliminationProtocol: p, Phase: p.Current()}
+	today := time.Now().Format(dateFormat)
+
+	from, to := entryDateBounds(p.StartDate, p.EndDate())
+	meals, err := queryMeals(profileID, "deleted_at IS NULL AND timestamp >= ? AND timestamp < ? ORDER BY timestamp", from, to)
+	if err != nil {
+		return rep, err
+	}
+	symptoms, err := querySymptoms(profileID, "deleted_at IS NULL AND timestamp >= ? AND timestamp < ? ORDER BY timestamp", from, to)
+	if err != nil {
+		return rep, err
+	}
+
+	for _, m := range meals {
+		if m.Violations = p.violations(m, group); len(m.Violations) > 0 {
+			rep.Violations = append(rep.Violations, m)
+		}
+	}
+
+	rep.Baseline.End = addDays(p.ReintroductionStart(), -1)
+	rep.Baseline.Start = addDays(p.ReintroductionStart(), -eliminationBaselineDays)
+	if rep.Baseline.Start < p.StartDate {
+		rep.Baseline.Start = p.StartDate
+	}
+	// While the elimination phase is still running, the baseline so far is
+	// used
+	end := rep.Baseline.End
+	if end > today {
+		end = today
+	}
+	if end >= rep.Baseline.Start {
+		rep.Baseline.Symptoms, rep.Baseline.MeanSeverity, _, _ = symptomStats(symptomsBetween(symptoms, rep.Baseline.Start, end))
+		rep.Baseline.SymptomsPerDay = float64(rep.Baseline.Symptoms) / float64(daysBetween(rep.Baseline.Start, end)+1)
+	}
+
+	for _, c := range p.Challenges() {
+		res := ChallengeResult{EliminationChallenge: c, Status: "done"}
+		end = c.End
+		if c.Start > today {
+			res.Status = "planned"
+			rep.Results = append(rep.Results, res)
+			continue
+		}
+		if c.End >= today {
+			res.Status = "ongoing"
+			end = today
+		}
+		for _, m := range meals {
+			if d := m.Timestamp.Format(dateFormat); d < c.Start || d > end {
+				continue
+			}
+			for _, item := range m.Items {
+				if containsFood([]string{c.Food}, group(item.Name)) {
+					res.Eaten = true
+				}
+			}
+		}
+		res.Symptoms, res.MeanSeverity, res.MaxSeverity, res.SymptomTypes = symptomStats(symptomsBetween(symptoms, c.Start, end))
+		res.SymptomsPerDay = float64(res.Symptoms) / float64(daysBetween(c.Start, end)+1)
+		res.Reaction = res.Eaten && res.Symptoms >= minReactionSymptoms &&
+			(res.SymptomsPerDay >= reactionRateRatio*rep.Baseline.SymptomsPerDay ||
+				res.MeanSeverity >= rep.Baseline.MeanSeverity+reactionSeverityRise)
+		rep.Results = append(rep.Results, res)
+	}
+	return rep, nil
+}
+
+// eliminationHandler shows the profile's elimination protocols with their
+// results and, on POST, adds a new protocol.
+func eliminationHandler(w http.ResponseWriter, r *http.Request) {
+	pid := currentProfileID(r)
+	if r.Method == http.MethodPost {
+		p, err := parseEliminationForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveEliminationProtocol(pid, p); err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/elimination", http.StatusSeeOther)
+		return
+	}
+	protocols, err := getEliminationProtocols(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente protokoller", http.StatusInternalServerError)
+		return
+	}
+	foods, err := getAllFoods(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente matvarer", http.StatusInternalServerError)
+		return
+	}
+	group := treeGrouper(newFoodTree(foods), -1)
+	var reports []EliminationReport
+	for _, p := range protocols {
+		rep, err := eliminationReport(pid, p, group)
+		if err != nil {
+			http.Error(w, "kunne ikke beregne resultater", http.StatusInternalServerError)
+			return
+		}
+		for i := range rep.Violations {
+			rep.Violations[i].DisplayTime = rep.Violations[i].Timestamp.Format("2006-01-02 15:04")
+		}
+		reports = append(reports, rep)
+	}
+	data := struct {
+		Reports       []EliminationReport
+		Today         string
+		ChallengeDays int
+	}{reports, time.Now().Format(dateFormat), defaultChallengeDays}
+	if err := templates.ExecuteTemplate(w, "elimination.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// deleteEliminationHandler deletes a protocol. Logged entries are kept.
+func deleteEliminationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/elimination", http.StatusSeeOther)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM elimination_protocols WHERE id = ? AND profile_id = ?", r.FormValue("id"), currentProfileID(r)); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/elimination", http.StatusSeeOther)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventKind is a user-defined kind of lifestyle event, such as sleep or stress.
+type EventKind struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+}
+
+// Event is a logged lifestyle event. Value is optional; events without a
+// value count as 1 in analysis. EndTimestamp is set for events that last a
+// while, such as sleep or menstruation.
+type Event struct {
+	ID        int       `json:"id"`
+	KindID    int       `json:"kind_id"`
+	Kind      string    `json:"kind"`
+	Unit      string    `json:"unit,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// TZ is the IANA zone or UTC offset the event was logged in. Empty means
+	// the server's zone.
+	TZ           string     `json:"tz,omitempty"`
+	EndTimestamp *time.Time `json:"end_timestamp,omitempty"`
+	Value        *float64   `json:"value,omitempty"`
+	Note         string     `json:"note"`
+	DisplayTime  string     `json:"-"`
+	InputTime    string     `json:"-"`
+	EndInputTime string     `json:"-"`
+}
+
+// ValueText returns the value with its unit, or "" if no value was logged.
+func (e Event) ValueText() string {
+	if e.Value == nil {
+		return ""
+	}
+	v := strconv.FormatFloat(*e.Value, 'f', -1, 64)
+	if e.Unit != "" {
+		v += " " + e.Unit
+	}
+	return v
+}
+
+// Duration returns the formatted duration, or "" for events without an end.
+func (e Event) Duration() string {
+	if e.EndTimestamp == nil {
+		return ""
+	}
+	return formatDuration(e.EndTimestamp.Sub(e.Timestamp))
+}
+
+// ValueInput returns the bare value for form inputs.
+func (e Event) ValueInput() string {
+	if e.Value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*e.Value, 'f', -1, 64)
+}
+
+// eventColumns lists the columns read by scanEventRow, in order. Queries must
+// join event_kinds as k.
+const eventColumns = "e.id, e.kind_id, k.name, k.unit, e.timestamp, e.tz, e.end_timestamp, e.value, e.note"
+
+// scanEventRow scans a database row into an Event struct.
+func scanEventRow(rows rowScanner) (Event, error) {
+	var e Event
+	var ts string
+	var endTs, note sql.NullString
+	var value sql.NullFloat64
+	if err := rows.Scan(&e.ID, &e.KindID, &e.Kind, &e.Unit, &ts, &e.TZ, &endTs, &value, &note); err != nil {
+		return e, err
+	}
+	t, err := parseRFC3339(ts)
+	if err != nil {
+		return e, err
+	}
+	// Times are shown as the wall-clock time where the event was logged
+	loc := entryLocation(e.TZ)
+	e.Timestamp = t.In(loc)
+	if endTs.Valid {
+		end, err := parseRFC3339(endTs.String)
+		if err != nil {
+			return e, err
+		}
+		end = end.In(loc)
+		e.EndTimestamp = &end
+		e.EndInputTime = end.Format(timestampFormat)
+	}
+	e.DisplayTime = e.Timestamp.Format(displayFormat)
+	e.InputTime = e.Timestamp.Format(timestampFormat)
+	if value.Valid {
+		e.Value = &value.Float64
+	}
+	e.Note = note.String
+	return e, nil
+}
+
+// defaultEventKinds are the event kinds a new profile starts with.
+var defaultEventKinds = []EventKind{
+	{Name: "Søvn", Unit: "timer"},
+	{Name: "Trening", Unit: "minutter"},
+	{Name: "Stress", Unit: "1–10"},
+	{Name: "Menstruasjon"},
+	{Name: "Alkohol", Unit: "enheter"},
+}
+
+// insertDefaultEventKinds adds the default event kinds that a profile does
+// not have yet.
+func insertDefaultEventKinds(tx *sql.Tx, profileID int64) error {
+	for _, k := range defaultEventKinds {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO event_kinds (profile_id, name, unit) VALUES (?, ?, ?)", profileID, k.Name, k.Unit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getEventKinds retrieves a profile's event kinds, sorted by name.
+func getEventKinds(profileID int64) ([]EventKind, error) {
+	rows, err := db.Query("SELECT id, name, unit FROM event_kinds WHERE profile_id = ? ORDER BY name COLLATE NOCASE", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var kinds []EventKind
+	for rows.Next() {
+		var k EventKind
+		if err := rows.Scan(&k.ID, &k.Name, &k.Unit); err != nil {
+			return nil, err
+		}
+		kinds = append(kinds, k)
+	}
+	return kinds, rows.Err()
+}
+
+// getAllEvents retrieves all of a profile's events from the database, newest
+// first.
+func getAllEvents(profileID int64) ([]Event, error) {
+	rows, err := db.Query("SELECT "+eventColumns+" FROM events e JOIN event_kinds k ON k.id = e.kind_id WHERE e.profile_id = ? ORDER BY e.timestamp DESC", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		e, err := scanEventRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// insertEvent stores a new event for a profile and returns its ID.
+func insertEvent(profileID int64, e Event) (int64, error) {
+	res, err := db.Exec("INSERT INTO events (profile_id, kind_id, timestamp, tz, end_timestamp, value, note) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		profileID, e.KindID, e.Timestamp.UTC().Format(time.RFC3339), e.TZ, nullableTimestamp(e.EndTimestamp), e.Value, e.Note)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// eventKindExists reports whether a profile has an event kind with the given
+// ID.
+func eventKindExists(profileID int64, id int) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM event_kinds WHERE id = ? AND profile_id = ?", id, profileID).Scan(&n)
+	return n > 0, err
+}
+
+// parseEventValue parses an optional numeric value, accepting a decimal comma.
+func parseEventValue(v string) (*float64, error) {
+	v = strings.TrimSpace(strings.Replace(v, ",", ".", 1))
+	if v == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New("ugyldig verdi")
+	}
+	return &f, nil
+}
+
+// parseEventForm reads an event from the index or edit form.
+func parseEventForm(r *http.Request) (Event, error) {
+	var e Event
+	kindID, err := strconv.Atoi(r.FormValue("kind_id"))
+	if err != nil {
+		return e, errors.New("hendelsestype må velges")
+	}
+	e.KindID = kindID
+	if e.Value, err = parseEventValue(r.FormValue("value")); err != nil {
+		return e, err
+	}
+	// The forms send the wall-clock time and the zone: the browser's for new
+	// events and the logged zone when editing
+	if e.Timestamp, e.TZ, err = parseEntryTime(r.FormValue("timestamp"), r.FormValue("tz")); err != nil {
+		return e, err
+	}
+	// Events have no ongoing state, so only the end time is read
+	if e.EndTimestamp, _, err = parseSymptomEnd(r, e.Timestamp); err != nil {
+		return e, err
+	}
+	e.Note = r.FormValue("note")
+	return e, nil
+}
+
+// eventKindsHandler lists event kinds on GET and creates a new kind on POST.
+func eventKindsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		name := strings.TrimSpace(r.FormValue("name"))
+		unit := strings.TrimSpace(r.FormValue("unit"))
+		if name == "" {
+			http.Error(w, "navn må oppgis", http.StatusBadRequest)
+			return
+		}
+		_, err := db.Exec("INSERT INTO event_kinds (profile_id, name, unit) VALUES (?, ?, ?)", currentProfileID(r), name, unit)
+		if isUniqueViolation(err) {
+			http.Error(w, "hendelsestypen finnes allerede", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/events/kinds", http.StatusSeeOther)
+		return
+	}
+	kinds, err := getEventKinds(currentProfileID(r))
+	if err != nil {
+		http.Error(w, "kunne ikke hente hendelsestyper", http.StatusInternalServerError)
+		return
+	}
+	if err := templates.ExecuteTemplate(w, "event_kinds.html", struct{ Kinds []EventKind }{kinds}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// deleteEventKindHandler deletes one of the profile's event kinds together
+// with its events.
+func deleteEventKindHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/events/kinds", http.StatusSeeOther)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM event_kinds WHERE id = ? AND profile_id = ?", r.FormValue("id"), currentProfileID(r)); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/events/kinds", http.StatusSeeOther)
+}
+
+// eventsHandler logs a new event from the index page.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	e, err := parseEventForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok, err := eventKindExists(currentProfileID(r), e.KindID); err != nil {
+		http.Error(w, "kunne ikke hente hendelsestyper", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "ukjent hendelsestype", http.StatusBadRequest)
+		return
+	}
+	if _, err := insertEvent(currentProfileID(r), e); err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// editEventHandler displays a form to edit an existing event.
+func editEventHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	e, err := scanEventRow(db.QueryRow("SELECT "+eventColumns+" FROM events e JOIN event_kinds k ON k.id = e.kind_id WHERE e.id = ? AND e.profile_id = ?", id, currentProfileID(r)))
+	if err == sql.ErrNoRows {
+		http.Error(w, "hendelse ikke funnet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "kunne ikke hente hendelse", http.StatusInternalServerError)
+		return
+	}
+	kinds, err := getEventKinds(currentProfileID(r))
+	if err != nil {
+		http.Error(w, "kunne ikke hente hendelsestyper", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		EventKinds []EventKind
+		Event      Event
+	}{kinds, e}
+	if err := templates.ExecuteTemplate(w, "edit_event.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// updateEventHandler processes the event update form.
+func updateEventHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	e, err := parseEventForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok, err := eventKindExists(currentProfileID(r), e.KindID); err != nil {
+		http.Error(w, "kunne ikke hente hendelsestyper", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "ukjent hendelsestype", http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("UPDATE events SET kind_id = ?, timestamp = ?, tz = ?, end_timestamp = ?, value = ?, note = ? WHERE id = ? AND profile_id = ?",
+		e.KindID, e.Timestamp.UTC().Format(time.RFC3339), e.TZ, nullableTimestamp(e.EndTimestamp), e.Value, e.Note, r.FormValue("id"), currentProfileID(r))
+	if err != nil {
+		http.Error(w, "feil ved oppdatering", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// deleteEventHandler deletes an event.
+func deleteEventHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM events WHERE id = ? AND profile_id = ?", r.FormValue("id"), currentProfileID(r)); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// apiEventHandler logs an event from JSON. The kind is given by name and must
+// already exist.
+func apiEventHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "kun POST er støttet", http.StatusMethodNotAllowed)
+		return
+	}
+	type EventInput struct {
+		Kind         string   `json:"kind"`
+		Value        *float64 `json:"value"`
+		Timestamp    string   `json:"timestamp"`
+		TZ           string   `json:"tz"`
+		EndTimestamp string   `json:"end_timestamp"`
+		Note         string   `json:"note"`
+	}
+	var input EventInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "ugyldig JSON", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(input.Kind) == "" || strings.TrimSpace(input.Timestamp) == "" {
+		http.Error(w, "kind og timestamp må oppgis", http.StatusBadRequest)
+		return
+	}
+	e := Event{Value: input.Value, Note: input.Note}
+	err := db.QueryRow("SELECT id FROM event_kinds WHERE name = ? AND profile_id = ?", strings.TrimSpace(input.Kind), currentProfileID(r)).Scan(&e.KindID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "ukjent hendelsestype", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "kunne ikke hente hendelsestyper", http.StatusInternalServerError)
+		return
+	}
+	// The timestamps are wall-clock time in tz, or the server's zone if tz is
+	// omitted, unless they carry their own UTC offset
+	if e.Timestamp, e.TZ, err = parseEntryTime(input.Timestamp, input.TZ); err != nil {
+		http.Error(w, "ugyldig timestamp-format, bruk 2006-01-02T15:04 eller RFC3339", http.StatusBadRequest)
+		return
+	}
+	if e.EndTimestamp, _, err = parseSymptomEndValue(false, input.EndTimestamp, e.Timestamp); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := insertEvent(currentProfileID(r), e)
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		ID     int64  `json:"id"`
+	}{
+		Status: "ok",
+		ID:     id,
+	})
+}
+
+// parseIDList parses a comma-separated list of numeric IDs, ignoring
+// anything that is not a number.
+func parseIDList(v string) []int {
+	var ids []int
+	for _, s := range strings.Split(v, ",") {
+		if id, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// queryKindEvents returns a profile's events of the given kinds within a UTC
+// date range, keyed by kind name, for use as series in analysis. Events
+// without a value count as 1, and events with an end time cover their whole
+// interval.
+func queryKindEvents(profileID int64, start, end string, kindIDs []int) (map[string][]seriesEvent, error) {
+	events := make(map[string][]seriesEvent)
+	if len(kindIDs) == 0 {
+		return events, nil
+	}
+	args := []interface{}{profileID, end, start}
+	placeholders := make([]string, len(kindIDs))
+	for i, id := range kindIDs {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	rows, err := db.Query(
+		`SELECT e.timestamp, e.end_timestamp, e.value, k.name FROM events e JOIN event_kinds k ON k.id = e.kind_id
+		WHERE e.profile_id = ? AND DATE(e.timestamp) <= ? AND DATE(COALESCE(e.end_timestamp, e.timestamp)) >= ?
+		AND e.kind_id IN (`+strings.Join(placeholders, ", ")+`) ORDER BY e.timestamp ASC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts, name string
+		var endTs sql.NullString
+		var value sql.NullFloat64
+		if err := rows.Scan(&ts, &endTs, &value, &name); err != nil {
+			return nil, err
+		}
+		t, err := parseRFC3339(ts)
+		if err != nil {
+			continue
+		}
+		e := seriesEvent{Start: t, Value: 1}
+		if value.Valid {
+			e.Value = value.Float64
+		}
+		if endTs.Valid {
+			if et, err := parseRFC3339(endTs.String); err == nil {
+				e.End = et
+			}
+		}
+		events[name] = append(events[name], e)
+	}
+	return events, rows.Err()
+}
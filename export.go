@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// exportColumns are the CSV export columns. Each row fills in the columns
+// that apply to its type. Meal and symptom timestamps carry the UTC offset of
+// the zone they were logged in.
+var exportColumns = []string{"type", "id", "value", "timestamp", "note", "severity", "end_timestamp", "ongoing", "dose", "amount", "bristol", "urgency", "photos", "wellbeing", "energy", "mood", "stress", "tz"}
+
+// exportData holds everything included in an export.
+type exportData struct {
+	Meals       []Meal       `json:"meals"`
+	Symptoms    []Symptom    `json:"symptoms"`
+	Medications []Medication `json:"medications"`
+	Events      []Event      `json:"events"`
+	Stools      []Stool      `json:"stools"`
+	CheckIns    []CheckIn    `json:"checkins"`
+}
+
+// loadExportData loads all of a profile's entries for export. On failure it
+// returns a user-facing error message.
+func loadExportData(profileID int64) (exportData, string, error) {
+	var d exportData
+	var err error
+	if d.Meals, err = getAllMeals(profileID); err != nil {
+		return d, "kunne ikke hente måltider", err
+	}
+	if d.Symptoms, err = getAllSymptoms(profileID); err != nil {
+		return d, "kunne ikke hente symptomer", err
+	}
+	if d.Medications, err = getAllMedications(profileID); err != nil {
+		return d, "kunne ikke hente medisiner", err
+	}
+	if d.Events, err = getAllEvents(profileID); err != nil {
+		return d, "kunne ikke hente hendelser", err
+	}
+	if d.Stools, err = getAllStools(profileID); err != nil {
+		return d, "kunne ikke hente avføringslogg", err
+	}
+	if d.CheckIns, err = getAllCheckIns(profileID); err != nil {
+		return d, "kunne ikke hente innsjekkinger", err
+	}
+	return d, "", nil
+}
+
+// exportHandler exports all of the profile's data as CSV, JSON, or a zip
+// archive with both and the meal photos.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	data, msg, err := loadExportData(currentProfileID(r))
+	if err != nil {
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="export.json"`)
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			http.Error(w, "feil ved eksport", http.StatusInternalServerError)
+		}
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="export.zip"`)
+		if err := writeExportZip(w, data); err != nil {
+			http.Error(w, "feil ved eksport", http.StatusInternalServerError)
+		}
+	default:
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="export.csv"`)
+		if err := writeExportCSV(w, data); err != nil {
+			http.Error(w, "feil ved eksport", http.StatusInternalServerError)
+		}
+	}
+}
+
+// writeExportCSV writes all entries as CSV rows, one per entry.
+func writeExportCSV(w io.Writer, data exportData) error {
+	writer := csv.NewWriter(w)
+	writeRow := func(fields map[string]string) {
+		record := make([]string, len(exportColumns))
+		for i, col := range exportColumns {
+			record[i] = fields[col]
+		}
+		writer.Write(record)
+	}
+	writer.Write(exportColumns)
+	for _, m := range data.Meals {
+		photos := ""
+		for i, p := range m.Photos {
+			if i > 0 {
+				photos += " "
+			}
+			photos += p.Filename
+		}
+		writeRow(map[string]string{
+			"type": "meal", "id": strconv.Itoa(m.ID), "value": m.ItemsText(),
+			"timestamp": m.Timestamp.Format(time.RFC3339), "tz": m.TZ, "note": m.Note, "photos": photos,
+		})
+	}
+	for _, s := range data.Symptoms {
+		endTs := ""
+		if s.EndTimestamp != nil {
+			endTs = s.EndTimestamp.Format(time.RFC3339)
+		}
+		writeRow(map[string]string{
+			"type": "symptom", "id": strconv.Itoa(s.ID), "value": s.Description,
+			"timestamp": s.Timestamp.Format(time.RFC3339), "tz": s.TZ, "note": s.Note,
+			"severity": strconv.Itoa(s.Severity), "end_timestamp": endTs, "ongoing": strconv.FormatBool(s.Ongoing),
+		})
+	}
+	for _, m := range data.Medications {
+		writeRow(map[string]string{
+			"type": "medication", "id": strconv.Itoa(m.ID), "value": m.Name,
+			"timestamp": m.Timestamp.Format(time.RFC3339), "tz": m.TZ, "note": m.Note, "dose": m.Dose,
+		})
+	}
+	for _, e := range data.Events {
+		endTs := ""
+		if e.EndTimestamp != nil {
+			endTs = e.EndTimestamp.Format(time.RFC3339)
+		}
+		writeRow(map[string]string{
+			"type": "event", "id": strconv.Itoa(e.ID), "value": e.Kind,
+			"timestamp": e.Timestamp.Format(time.RFC3339), "tz": e.TZ, "note": e.Note,
+			"end_timestamp": endTs, "amount": e.ValueInput(),
+		})
+	}
+	for _, st := range data.Stools {
+		writeRow(map[string]string{
+			"type": "stool", "id": strconv.Itoa(st.ID), "value": st.BristolText(),
+			"timestamp": st.Timestamp.Format(time.RFC3339), "tz": st.TZ, "note": st.Note,
+			"bristol": strconv.Itoa(st.Bristol), "urgency": strconv.Itoa(st.Urgency),
+		})
+	}
+	for _, c := range data.CheckIns {
+		writeRow(map[string]string{
+			"type": "checkin", "timestamp": c.Date, "note": c.Note,
+			"wellbeing": strconv.Itoa(c.Wellbeing), "energy": strconv.Itoa(c.Energy),
+			"mood": strconv.Itoa(c.Mood), "stress": strconv.Itoa(c.Stress),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeExportZip writes a zip archive with export.json, export.csv and all
+// meal photos under photos/.
+func writeExportZip(w io.Writer, data exportData) error {
+	zw := zip.NewWriter(w)
+	now := time.Now()
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "export.json", Method: zip.Deflate, Modified: now})
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(data); err != nil {
+		return err
+	}
+	if f, err = zw.CreateHeader(&zip.FileHeader{Name: "export.csv", Method: zip.Deflate, Modified: now}); err != nil {
+		return err
+	}
+	if err := writeExportCSV(f, data); err != nil {
+		return err
+	}
+	for _, m := range data.Meals {
+		for _, p := range m.Photos {
+			if err := addFileToZip(zw, filepath.Join(photoDir, p.Filename), "photos/"+p.Filename); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// addFileToZip copies a file on disk into the archive. Missing files are
+// skipped, so a lost photo does not break the whole export.
+func addFileToZip(zw *zip.Writer, filename, name string) error {
+	src, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	// Images are already compressed
+	dst, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tag kinds stored in food_tags.
+const (
+	tagKindAllergen = "allergen"
+	tagKindFODMAP   = "fodmap"
+)
+
+var (
+	// categoryOptions are suggested food categories.
+	categoryOptions = []string{"Meieri", "Gluten/korn", "Belgfrukter", "Frukt", "Grønnsaker", "Kjøtt", "Fisk og sjømat", "Egg", "Nøtter og frø", "Drikke", "Søtsaker"}
+	// allergenOptions are the 14 allergens that must be declared on food in Norway and the EU.
+	allergenOptions = []string{"Gluten", "Skalldyr", "Egg", "Fisk", "Peanøtter", "Soya", "Melk", "Nøtter", "Selleri", "Sennep", "Sesamfrø", "Svoveldioksid og sulfitt", "Lupin", "Bløtdyr"}
+	// fodmapOptions are the FODMAP groups used in low-FODMAP diets.
+	fodmapOptions = []string{"Laktose", "Fruktose", "Fruktaner", "GOS", "Sorbitol", "Mannitol"}
+)
+
+// defaultFoods are the foods a new profile's catalog starts with.
+var defaultFoods = []Food{
+	{Name: "Brød", Category: "Gluten/korn", Allergens: []string{"Gluten"}, FODMAPs: []string{"Fruktaner"}},
+	{Name: "Melk", Category: "Meieri", Allergens: []string{"Melk"}, FODMAPs: []string{"Laktose"}},
+	{Name: "Ost", Category: "Meieri", Allergens: []string{"Melk"}},
+}
+
+// Food is an entry in a profile's food catalog. Foods form a tree through
+// ParentID, e.g. Meieri → Ost → Brie.
+type Food struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Category  string   `json:"category"`
+	ParentID  int      `json:"parent_id,omitempty"`
+	Allergens []string `json:"allergens"`
+	FODMAPs   []string `json:"fodmaps"`
+	// Depth and Path are set by foodTree.ordered for display.
+	Depth int    `json:"-"`
+	Path  string `json:"-"`
+}
+
+// HasAllergen reports whether the food is tagged with the given allergen.
+func (f Food) HasAllergen(tag string) bool {
+	return containsString(f.Allergens, tag)
+}
+
+// HasFODMAP reports whether the food is tagged with the given FODMAP group.
+func (f Food) HasFODMAP(tag string) bool {
+	return containsString(f.FODMAPs, tag)
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getAllFoods retrieves a profile's food catalog, sorted by name, with tags.
+func getAllFoods(profileID int64) ([]Food, error) {
+	rows, err := db.Query("SELECT id, name, category, parent_id FROM foods WHERE profile_id = ? ORDER BY name COLLATE NOCASE", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var foods []Food
+	byID := make(map[int]int)
+	for rows.Next() {
+		var f Food
+		var parentID sql.NullInt64
+		if err := rows.Scan(&f.ID, &f.Name, &f.Category, &parentID); err != nil {
+			return nil, err
+		}
+		f.ParentID = int(parentID.Int64)
+		byID[f.ID] = len(foods)
+		foods = append(foods, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tagRows, err := db.Query(`SELECT t.food_id, t.kind, t.tag FROM food_tags t JOIN foods f ON f.id = t.food_id
+		WHERE f.profile_id = ? ORDER BY t.tag`, profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+	for tagRows.Next() {
+		var id int
+		var kind, tag string
+		if err := tagRows.Scan(&id, &kind, &tag); err != nil {
+			return nil, err
+		}
+		i, ok := byID[id]
+		if !ok {
+			continue
+		}
+		switch kind {
+		case tagKindAllergen:
+			foods[i].Allergens = append(foods[i].Allergens, tag)
+		case tagKindFODMAP:
+			foods[i].FODMAPs = append(foods[i].FODMAPs, tag)
+		}
+	}
+	return foods, tagRows.Err()
+}
+
+// getFood retrieves a single food from a profile's catalog.
+func getFood(profileID int64, id int) (Food, error) {
+	foods, err := getAllFoods(profileID)
+	if err != nil {
+		return Food{}, err
+	}
+	for _, f := range foods {
+		if f.ID == id {
+			return f, nil
+		}
+	}
+	return Food{}, sql.ErrNoRows
+}
+
+// foodNames returns the names of all foods in a profile's catalog.
+func foodNames(profileID int64) ([]string, error) {
+	foods, err := getAllFoods(profileID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(foods))
+	for i, f := range foods {
+		names[i] = f.Name
+	}
+	return names, nil
+}
+
+// saveFood inserts the food into a profile's catalog if its ID is zero and
+// updates it otherwise, replacing its tags.
+func saveFood(profileID int64, f Food) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	id := int64(f.ID)
+	var parentID interface{}
+	if f.ParentID != 0 {
+		parentID = f.ParentID
+	}
+	if id == 0 {
+		res, err := tx.Exec("INSERT INTO foods (profile_id, name, category, parent_id) VALUES (?, ?, ?, ?)", profileID, f.Name, f.Category, parentID)
+		if err != nil {
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	} else {
+		res, err := tx.Exec("UPDATE foods SET name = ?, category = ?, parent_id = ? WHERE id = ? AND profile_id = ?", f.Name, f.Category, parentID, id, profileID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return sql.ErrNoRows
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM food_tags WHERE food_id = ?", id); err != nil {
+		return err
+	}
+	if err := insertFoodTags(tx, id, f); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertFoodTags stores the allergen and FODMAP tags of a food.
+func insertFoodTags(tx *sql.Tx, id int64, f Food) error {
+	for kind, tags := range map[string][]string{tagKindAllergen: f.Allergens, tagKindFODMAP: f.FODMAPs} {
+		for _, tag := range tags {
+			if _, err := tx.Exec("INSERT INTO food_tags (food_id, kind, tag) VALUES (?, ?, ?)", id, kind, tag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// insertDefaultFoods adds the default foods that are missing from a
+// profile's catalog.
+func insertDefaultFoods(tx *sql.Tx, profileID int64) error {
+	for _, f := range defaultFoods {
+		res, err := tx.Exec("INSERT OR IGNORE INTO foods (profile_id, name, category) VALUES (?, ?, ?)", profileID, f.Name, f.Category)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if err := insertFoodTags(tx, id, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFoodForm reads a food from the catalog form. Only known allergens and
+// FODMAP groups are accepted.
+func parseFoodForm(r *http.Request) (Food, error) {
+	if err := r.ParseForm(); err != nil {
+		return Food{}, err
+	}
+	f := Food{
+		Name:     strings.TrimSpace(r.PostForm.Get("name")),
+		Category: strings.TrimSpace(r.PostForm.Get("category")),
+	}
+	if f.Name == "" {
+		return f, errors.New("navn må oppgis")
+	}
+	if v := r.PostForm.Get("parent_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return f, errors.New("ugyldig overordnet matvare")
+		}
+		f.ParentID = id
+	}
+	for _, tag := range r.PostForm["allergen"] {
+		if containsString(allergenOptions, tag) {
+			f.Allergens = append(f.Allergens, tag)
+		}
+	}
+	for _, tag := range r.PostForm["fodmap"] {
+		if containsString(fodmapOptions, tag) {
+			f.FODMAPs = append(f.FODMAPs, tag)
+		}
+	}
+	return f, nil
+}
+
+// isUniqueViolation reports whether err is a UNIQUE constraint failure.
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// foodTree indexes the food catalog for walking the parent/child hierarchy.
+type foodTree struct {
+	foods  []Food
+	byID   map[int]int
+	byName map[string]int
+}
+
+func newFoodTree(foods []Food) foodTree {
+	t := foodTree{foods: foods, byID: make(map[int]int), byName: make(map[string]int)}
+	for i, f := range foods {
+		t.byID[f.ID] = i
+		t.byName[strings.ToLower(f.Name)] = i
+	}
+	return t
+}
+
+// lineage returns the food and its ancestors, nearest first. The walk stops
+// at a missing parent or a cycle.
+func (t foodTree) lineage(f Food) []Food {
+	out := []Food{f}
+	seen := map[int]bool{f.ID: true}
+	for f.ParentID != 0 {
+		i, ok := t.byID[f.ParentID]
+		if !ok || seen[f.ParentID] {
+			break
+		}
+		f = t.foods[i]
+		seen[f.ID] = true
+		out = append(out, f)
+	}
+	return out
+}
+
+// isDescendant reports whether the food with id lies below ancestorID.
+func (t foodTree) isDescendant(id, ancestorID int) bool {
+	i, ok := t.byID[id]
+	if !ok {
+		return false
+	}
+	for _, a := range t.lineage(t.foods[i])[1:] {
+		if a.ID == ancestorID {
+			return true
+		}
+	}
+	return false
+}
+
+// ordered returns the foods in depth-first tree order with Depth and Path set.
+func (t foodTree) ordered() []Food {
+	children := make(map[int][]Food)
+	for _, f := range t.foods {
+		parent := f.ParentID
+		if _, ok := t.byID[parent]; !ok || t.isDescendant(parent, f.ID) {
+			parent = 0
+		}
+		children[parent] = append(children[parent], f)
+	}
+	var out []Food
+	var walk func(parent int, depth int, path string)
+	walk = func(parent int, depth int, path string) {
+		for _, f := range children[parent] {
+			f.Depth = depth
+			f.Path = f.Name
+			if path != "" {
+				f.Path = path + " → " + f.Name
+			}
+			out = append(out, f)
+			walk(f.ID, depth+1, f.Path)
+		}
+	}
+	walk(0, 0, "")
+	return out
+}
+
+// foodGrouper maps a meal item name to the keys of the series it contributes
+// to in analysis.
+type foodGrouper func(name string) []string
+
+// newFoodGrouper returns a grouper for the given mode: "item" (default) keeps
+// raw item names, while "category", "allergen" and "fodmap" map items through
+// the profile's food catalog and drop items missing from it. "tree" rolls each
+// item up to itself and every ancestor in the food hierarchy; if level is zero
+// or more, only nodes at that depth (0 = top level) are kept.
+func newFoodGrouper(profileID int64, mode string, level int) (foodGrouper, error) {
+	if mode == "" || mode == "item" {
+		return func(name string) []string { return []string{name} }, nil
+	}
+	if mode != "category" && mode != tagKindAllergen && mode != tagKindFODMAP && mode != "tree" {
+		return nil, errors.New("ugyldig gruppering")
+	}
+	foods, err := getAllFoods(profileID)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "tree" {
+		return treeGrouper(newFoodTree(foods), level), nil
+	}
+	groups := make(map[string][]string)
+	for _, f := range foods {
+		key := strings.ToLower(f.Name)
+		switch mode {
+		case "category":
+			if f.Category != "" {
+				groups[key] = []string{f.Category}
+			}
+		case tagKindAllergen:
+			groups[key] = f.Allergens
+		case tagKindFODMAP:
+			groups[key] = f.FODMAPs
+		}
+	}
+	return func(name string) []string { return groups[strings.ToLower(name)] }, nil
+}
+
+// treeGrouper rolls items up the food hierarchy. Items missing from the
+// catalog are treated as top-level nodes.
+func treeGrouper(tree foodTree, level int) foodGrouper {
+	return func(name string) []string {
+		i, ok := tree.byName[strings.ToLower(name)]
+		if !ok {
+			if level > 0 {
+				return nil
+			}
+			return []string{name}
+		}
+		lineage := tree.lineage(tree.foods[i])
+		var out []string
+		for j, f := range lineage {
+			depth := len(lineage) - 1 - j
+			if level < 0 || depth == level {
+				out = append(out, f.Name)
+			}
+		}
+		return out
+	}
+}
+
+// parseGroupLevel reads the optional "level" query parameter used with
+// group=tree. It returns -1 when no level is given.
+func parseGroupLevel(r *http.Request) int {
+	level, err := strconv.Atoi(r.URL.Query().Get("level"))
+	if err != nil || level < 0 {
+		return -1
+	}
+	return level
+}
+
+// foodsPageHandler lists the profile's food catalog and, on POST, adds a new
+// food.
+func foodsPageHandler(w http.ResponseWriter, r *http.Request) {
+	pid := currentProfileID(r)
+	if r.Method == http.MethodPost {
+		f, err := parseFoodForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := checkFoodParent(pid, f); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveFood(pid, f); isUniqueViolation(err) {
+			http.Error(w, "matvaren finnes allerede", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/foods", http.StatusSeeOther)
+		return
+	}
+	foods, err := getAllFoods(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente matvarer", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Foods           []Food
+		CategoryOptions []string
+		AllergenOptions []string
+		FODMAPOptions   []string
+	}{newFoodTree(foods).ordered(), foodCategoryOptions(foods), allergenOptions, fodmapOptions}
+	if err := templates.ExecuteTemplate(w, "foods.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// foodCategoryOptions returns the suggested categories plus any others in use.
+func foodCategoryOptions(foods []Food) []string {
+	options := append([]string(nil), categoryOptions...)
+	for _, f := range foods {
+		if f.Category != "" && !containsString(options, f.Category) {
+			options = append(options, f.Category)
+		}
+	}
+	sort.Strings(options)
+	return options
+}
+
+// editFoodHandler displays a form to edit a food in the catalog.
+func editFoodHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Redirect(w, r, "/foods", http.StatusSeeOther)
+		return
+	}
+	pid := currentProfileID(r)
+	f, err := getFood(pid, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "matvare ikke funnet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "kunne ikke hente matvare", http.StatusInternalServerError)
+		return
+	}
+	foods, err := getAllFoods(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente matvarer", http.StatusInternalServerError)
+		return
+	}
+	// A food cannot be moved below itself or one of its descendants
+	tree := newFoodTree(foods)
+	var parentOptions []Food
+	for _, o := range tree.ordered() {
+		if o.ID != f.ID && !tree.isDescendant(o.ID, f.ID) {
+			parentOptions = append(parentOptions, o)
+		}
+	}
+	data := struct {
+		Food            Food
+		ParentOptions   []Food
+		CategoryOptions []string
+		AllergenOptions []string
+		FODMAPOptions   []string
+	}{f, parentOptions, foodCategoryOptions(foods), allergenOptions, fodmapOptions}
+	if err := templates.ExecuteTemplate(w, "edit_food.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// updateFoodHandler processes the food update form.
+func updateFoodHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/foods", http.StatusSeeOther)
+		return
+	}
+	f, err := parseFoodForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.ID, err = strconv.Atoi(r.FormValue("id")); err != nil {
+		http.Error(w, "ugyldig id", http.StatusBadRequest)
+		return
+	}
+	pid := currentProfileID(r)
+	if err := checkFoodParent(pid, f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveFood(pid, f); isUniqueViolation(err) {
+		http.Error(w, "matvaren finnes allerede", http.StatusBadRequest)
+		return
+	} else if err == sql.ErrNoRows {
+		http.Error(w, "matvare ikke funnet", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "feil ved oppdatering", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/foods", http.StatusSeeOther)
+}
+
+// checkFoodParent verifies that the food's parent exists in the profile's
+// catalog and that setting it does not create a cycle in the hierarchy.
+func checkFoodParent(profileID int64, f Food) error {
+	if f.ParentID == 0 {
+		return nil
+	}
+	if f.ParentID == f.ID {
+		return errors.New("en matvare kan ikke ligge under seg selv")
+	}
+	foods, err := getAllFoods(profileID)
+	if err != nil {
+		return err
+	}
+	tree := newFoodTree(foods)
+	if _, ok := tree.byID[f.ParentID]; !ok {
+		return errors.New("overordnet matvare finnes ikke")
+	}
+	if f.ID != 0 && tree.isDescendant(f.ParentID, f.ID) {
+		return errors.New("en matvare kan ikke ligge under sine egne undergrupper")
+	}
+	return nil
+}
+
+// deleteFoodHandler removes a food from the profile's catalog. Its children
+// move up to the top level. Logged meals are not affected.
+func deleteFoodHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/foods", http.StatusSeeOther)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM foods WHERE id = ? AND profile_id = ?", r.FormValue("id"), currentProfileID(r)); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/foods", http.StatusSeeOther)
+}
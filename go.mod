@@ -2,4 +2,7 @@ module github.com/asmundstavdahl/mat-og-symptomdagbok
 
 go 1.19
 
-require github.com/mattn/go-sqlite3 v1.14.28
+require (
+	github.com/mattn/go-sqlite3 v1.14.28
+	golang.org/x/crypto v0.24.0
+)
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -17,6 +19,41 @@ func parseDateOnly(dateStr string) (time.Time, error) {
 	return time.Parse(dateFormat, dateStr)
 }
 
+// parseLocalDateRange parses the "start" and "end" query parameters as local
+// calendar dates. The returned end is the start of the day after the end date,
+// so the range is [start, end). Ranges longer than maxDateRangeDays are
+// rejected, since reports allocate a row per day.
+func parseLocalDateRange(r *http.Request) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation(dateFormat, r.URL.Query().Get("start"), time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("ugyldig startdato")
+	}
+	end, err := time.ParseInLocation(dateFormat, r.URL.Query().Get("end"), time.Local)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("ugyldig sluttdato")
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, errors.New("sluttdato er før startdato")
+	}
+	if !end.Before(start.AddDate(0, 0, maxDateRangeDays)) {
+		return time.Time{}, time.Time{}, errors.New("perioden er for lang")
+	}
+	return start, end.AddDate(0, 0, 1), nil
+}
+
+// splitMealItems splits a comma-separated list of meal items into trimmed,
+// non-empty item names.
+func splitMealItems(items string) []string {
+	var out []string
+	for _, item := range strings.Split(items, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 // writeJSONError writes an error response as JSON.
 func writeJSONError(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
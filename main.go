@@ -2,8 +2,8 @@ package main
 
 import (
 	"database/sql"
-	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -17,23 +17,46 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// dbDSN opens data.db with foreign key enforcement, so that child rows such as
+// meal_items are removed together with their parent.
+const dbDSN = "data.db?_foreign_keys=on"
+
 const (
 	// Time format constants
 	timestampFormat = "2006-01-02T15:04"
+	displayFormat   = "2006-01-02 15:04"
 	dateFormat      = "2006-01-02"
 
 	// Analysis constants
 	defaultBinSizeMinutes = 15.0
 	defaultTauMinutes     = 20.0
 	defaultLookAheadDays  = 7
+	minBinSizeMinutes     = 1.0
+	maxLookAheadDays      = 30
 	defaultTimeSeriesDays = 30
 	defaultMaxLagHours    = 12 // Added this constant
+	defaultReportDays     = 14
+	maxDateRangeDays      = 3 * 366
+	defaultHorizonHours   = 24
+
+	// medicationSeriesPrefix marks medication input series in analysis results
+	medicationSeriesPrefix = "💊 "
+	// eventSeriesPrefix marks lifestyle event input series in analysis results
+	eventSeriesPrefix = "📌 "
 )
 
-// queryMealTimestamps retrieves meal timestamps within a date range
-func queryMealTimestamps(start, end string) ([]time.Time, error) {
-	rows, err := db.Query(
-		"SELECT timestamp FROM meals WHERE DATE(timestamp) BETWEEN ? AND ? ORDER BY timestamp ASC", start, end)
+// queryMealTimestamps retrieves a profile's meal timestamps within a range of
+// dates, local to the zone each meal was logged in.
+// If item is non-empty, only meals containing that item are included.
+func queryMealTimestamps(profileID int64, start, end, item string) ([]time.Time, error) {
+	from, to := entryDateBounds(start, end)
+	query := "SELECT timestamp, tz FROM meals WHERE profile_id = ? AND deleted_at IS NULL AND timestamp >= ? AND timestamp < ?"
+	args := []interface{}{profileID, from, to}
+	if item != "" {
+		query += " AND EXISTS (SELECT 1 FROM meal_items i WHERE i.meal_id = meals.id AND i.name = ? COLLATE NOCASE)"
+		args = append(args, item)
+	}
+	rows, err := db.Query(query+" ORDER BY timestamp ASC", args...)
 	if err != nil {
 		return nil, err
 	}
@@ -41,23 +64,34 @@ func queryMealTimestamps(start, end string) ([]time.Time, error) {
 
 	var times []time.Time
 	for rows.Next() {
-		var ts string
-		if err := rows.Scan(&ts); err != nil {
+		var ts, tz string
+		if err := rows.Scan(&ts, &tz); err != nil {
 			return nil, err
 		}
 		t, err := parseRFC3339(ts)
 		if err != nil {
 			continue
 		}
+		if d := entryDate(t, tz); d < start || d > end {
+			continue
+		}
 		times = append(times, t)
 	}
 	return times, nil
 }
 
-// querySymptomTimestamps retrieves symptom timestamps within a date range
-func querySymptomTimestamps(start, end string) ([]time.Time, error) {
-	rows, err := db.Query(
-		"SELECT timestamp FROM symptoms WHERE DATE(timestamp) BETWEEN ? AND ? ORDER BY timestamp ASC", start, end)
+// querySymptomTimestamps retrieves a profile's symptom timestamps within a
+// range of dates, local to the zone each symptom was logged in. If
+// symptomType is non-empty, only symptoms with that description are included.
+func querySymptomTimestamps(profileID int64, start, end, symptomType string) ([]time.Time, error) {
+	from, to := entryDateBounds(start, end)
+	query := "SELECT timestamp, tz FROM symptoms WHERE profile_id = ? AND deleted_at IS NULL AND timestamp >= ? AND timestamp < ?"
+	args := []interface{}{profileID, from, to}
+	if symptomType != "" {
+		query += " AND description = ? COLLATE NOCASE"
+		args = append(args, symptomType)
+	}
+	rows, err := db.Query(query+" ORDER BY timestamp ASC", args...)
 	if err != nil {
 		return nil, err
 	}
@@ -65,25 +99,58 @@ func querySymptomTimestamps(start, end string) ([]time.Time, error) {
 
 	var times []time.Time
 	for rows.Next() {
-		var ts string
-		if err := rows.Scan(&ts); err != nil {
+		var ts, tz string
+		if err := rows.Scan(&ts, &tz); err != nil {
 			return nil, err
 		}
 		t, err := parseRFC3339(ts)
 		if err != nil {
 			continue
 		}
+		if d := entryDate(t, tz); d < start || d > end {
+			continue
+		}
 		times = append(times, t)
 	}
 	return times, nil
 }
 
+// unitOptions are suggested units for meal item quantities.
+var unitOptions = []string{"g", "dl", "l", "stk", "skive", "ss", "ts", "porsjon"}
+
 type templateData struct {
 	MealOptions    []string
+	UnitOptions    []string
 	SymptomOptions []string
 	Now            string
 	Meals          []Meal
+	MealTemplates  []MealTemplate
 	Symptoms       []Symptom
+	Medications    []Medication
+	// MedicationOptions are previously logged medication names.
+	MedicationOptions []string
+	Events            []Event
+	EventKinds        []EventKind
+	Stools            []Stool
+	BristolOptions    []BristolOption
+	UrgencyOptions    []string
+	Bristol           int
+	// CheckIn is today's check-in, shown with default scores if there is none
+	CheckIn        CheckIn
+	CheckInMetrics []CheckInMetric
+	CheckInScores  []int
+	MinSeverity    int
+	MaxSeverity    int
+	Severity       int
+	// Username is the logged-in user
+	Username string
+	// EliminationProtocol is the elimination diet running today, if any
+	EliminationProtocol *EliminationProtocol
+	// Trials are the challenge trials running today
+	Trials []Trial
+	// Profiles are the user's profiles, with the selected one in Profile
+	Profiles []Profile
+	Profile  Profile
 }
 
 var (
@@ -93,10 +160,12 @@ var (
 
 func main() {
 	port := flag.Int("port", 8080, "Port to run the server on")
+	flag.BoolVar(&allowSignup, "allow-signup", false, "Let anyone register an account (the first account can always be registered)")
+	flag.IntVar(&trashRetentionDays, "trash-retention-days", defaultTrashRetentionDays, "Days deleted entries are kept in the trash before they are purged (0 keeps them)")
 	flag.Parse()
 
 	var err error
-	db, err = sql.Open("sqlite3", "data.db")
+	db, err = sql.Open("sqlite3", dbDSN)
 	if err != nil {
 		log.Fatalf("database connection error: %v", err)
 	}
@@ -106,6 +175,8 @@ func main() {
 		log.Fatalf("migration error: %v", err)
 	}
 
+	go purgeTrashPeriodically()
+
 	templates, err = template.ParseGlob(filepath.Join("templates", "*.html"))
 	if err != nil {
 		log.Fatalf("parsing templates error: %v", err)
@@ -114,6 +185,14 @@ func main() {
 	// Serve static files (for plotly.min.js)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
 
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/register", registerHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/profiles", profilesHandler)
+	http.HandleFunc("/profiles/switch", switchProfileHandler)
+	http.HandleFunc("/profiles/rename", renameProfileHandler)
+	http.HandleFunc("/profiles/delete", deleteProfileHandler)
+
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/meals", mealsHandler)
 	http.HandleFunc("/symptoms", symptomsHandler)
@@ -121,49 +200,194 @@ func main() {
 	http.HandleFunc("/meals/edit", editMealHandler)
 	http.HandleFunc("/meals/update", updateMealHandler)
 	http.HandleFunc("/meals/delete", deleteMealHandler)
+	http.HandleFunc("/meals/photos/delete", deletePhotoHandler)
+	http.HandleFunc("/meals/repeat", repeatMealHandler)
+	http.HandleFunc("/meals/templates", mealTemplatesHandler)
+	http.HandleFunc("/meals/templates/log", logMealTemplateHandler)
+	http.HandleFunc("/meals/templates/delete", deleteMealTemplateHandler)
+	http.HandleFunc("/photos/", photoHandler)
 	http.HandleFunc("/symptoms/edit", editSymptomHandler)
 	http.HandleFunc("/symptoms/update", updateSymptomHandler)
 	http.HandleFunc("/symptoms/delete", deleteSymptomHandler)
+	http.HandleFunc("/symptoms/end", endSymptomHandler)
+	http.HandleFunc("/medications", medicationsHandler)
+	http.HandleFunc("/medications/edit", editMedicationHandler)
+	http.HandleFunc("/medications/update", updateMedicationHandler)
+	http.HandleFunc("/medications/delete", deleteMedicationHandler)
+	http.HandleFunc("/stools", stoolsHandler)
+	http.HandleFunc("/stools/edit", editStoolHandler)
+	http.HandleFunc("/stools/update", updateStoolHandler)
+	http.HandleFunc("/stools/delete", deleteStoolHandler)
+	http.HandleFunc("/checkins", checkInHandler)
+	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/events/edit", editEventHandler)
+	http.HandleFunc("/events/update", updateEventHandler)
+	http.HandleFunc("/events/delete", deleteEventHandler)
+	http.HandleFunc("/events/kinds", eventKindsHandler)
+	http.HandleFunc("/events/kinds/delete", deleteEventKindHandler)
+	http.HandleFunc("/foods", foodsPageHandler)
+	http.HandleFunc("/foods/edit", editFoodHandler)
+	http.HandleFunc("/foods/update", updateFoodHandler)
+	http.HandleFunc("/foods/delete", deleteFoodHandler)
+	http.HandleFunc("/elimination", eliminationHandler)
+	http.HandleFunc("/elimination/delete", deleteEliminationHandler)
+	http.HandleFunc("/trials", trialsHandler)
+	http.HandleFunc("/trials/delete", deleteTrialHandler)
 	http.HandleFunc("/export", exportHandler)
+	http.HandleFunc("/trash", trashHandler)
+	http.HandleFunc("/trash/restore", restoreHandler)
+	http.HandleFunc("/trash/purge", purgeHandler)
+	http.HandleFunc("/history", historyHandler)
+	http.HandleFunc("/history/revert", revertHandler)
+	http.HandleFunc("/settings", settingsHandler)
+	http.HandleFunc("/settings/suggestions", suggestionPrefHandler)
 	http.HandleFunc("/timeseries", timeSeriesPageHandler)
 	http.HandleFunc("/timeseries/data", timeSeriesDataHandler)
+	http.HandleFunc("/report", reportPageHandler)
+	http.HandleFunc("/report/data", reportDataHandler)
+	http.HandleFunc("/report/meal-symptom-data", mealSymptomDataHandler)
+	http.HandleFunc("/report/checkin-correlation", checkInCorrelationHandler)
+	http.HandleFunc("/meal-symptom-analysis", mealSymptomAnalysisPageHandler)
+	http.HandleFunc("/crosscorr", crossCorrPageHandler)
+	http.HandleFunc("/crosscorr/data", crossCorrDataHandler)
 
 	// API-endpoint for registrering av måltid
 	http.HandleFunc("/api/meal", apiMealHandler)
+	http.HandleFunc("/api/meal/template/", apiMealTemplateHandler)
+	http.HandleFunc("/api/suggest", apiSuggestHandler)
+	http.HandleFunc("/api/event", apiEventHandler)
+	http.HandleFunc("/api/meals", apiMealsHandler)
+	http.HandleFunc("/api/meals/", apiMealsHandler)
+	http.HandleFunc("/api/symptoms", apiSymptomsHandler)
+	http.HandleFunc("/api/symptoms/", apiSymptomsHandler)
 
 	log.Printf("Server starting on :%d", *port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), nil); err != nil {
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), requireLogin(http.DefaultServeMux)); err != nil {
 		log.Fatalf("server failed: %v", err)
 	}
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	meals, err := getAllMeals()
+	pid := currentProfileID(r)
+	meals, err := getAllMeals(pid)
 	if err != nil {
 		http.Error(w, "kunne ikke hente måltider", http.StatusInternalServerError)
 		return
 	}
-	// Set DisplayTime for meals to UTC string for client-side conversion
-	for i := range meals {
-		meals[i].DisplayTime = meals[i].Timestamp.Format("2006-01-02T15:04:00Z")
+	protocols, err := getEliminationProtocols(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente protokoller", http.StatusInternalServerError)
+		return
 	}
-
-	symptoms, err := getAllSymptoms()
+	if err := flagEliminationViolations(pid, protocols, meals); err != nil {
+		http.Error(w, "kunne ikke sjekke eliminasjonsdietten", http.StatusInternalServerError)
+		return
+	}
+	trials, err := getTrials(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forsøk", http.StatusInternalServerError)
+		return
+	}
+	mealOptions, err := mealOptions(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
+	symptomOptions, err := symptomOptions(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
+	mealTemplates, err := getMealTemplates(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente maler", http.StatusInternalServerError)
+		return
+	}
+	symptoms, err := getAllSymptoms(pid)
 	if err != nil {
 		http.Error(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
 		return
 	}
-	// Set DisplayTime for symptoms to UTC string for client-side conversion
-	for i := range symptoms {
-		symptoms[i].DisplayTime = symptoms[i].Timestamp.Format("2006-01-02T15:04:00Z")
+	medications, err := getAllMedications(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente medisiner", http.StatusInternalServerError)
+		return
+	}
+	medicationOptions, err := medicationNames(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente medisiner", http.StatusInternalServerError)
+		return
+	}
+
+	events, err := getAllEvents(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente hendelser", http.StatusInternalServerError)
+		return
+	}
+	eventKinds, err := getEventKinds(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente hendelsestyper", http.StatusInternalServerError)
+		return
+	}
+
+	stools, err := getAllStools(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente avføringslogg", http.StatusInternalServerError)
+		return
+	}
+
+	profiles, err := getProfiles(currentUser(r).ID)
+	if err != nil {
+		http.Error(w, "kunne ikke hente profiler", http.StatusInternalServerError)
+		return
+	}
+
+	today := time.Now().Format(dateFormat)
+	checkIn, err := getCheckIn(pid, today)
+	if err != nil {
+		http.Error(w, "kunne ikke hente innsjekking", http.StatusInternalServerError)
+		return
+	}
+	if checkIn == nil {
+		checkIn = &CheckIn{Date: today}
+		for _, m := range checkInMetrics {
+			checkIn.setScore(m.Key, defaultCheckInScore)
+		}
+	}
+	var checkInScores []int
+	for s := minCheckInScore; s <= maxCheckInScore; s++ {
+		checkInScores = append(checkInScores, s)
 	}
 
 	data := templateData{
-		MealOptions:    []string{"Brød", "Melk", "Ost"},
-		SymptomOptions: []string{"Hodepine", "Kvalme", "Tretthet"},
-		Now:            time.Now().Format("2006-01-02T15:04"),
-		Meals:          meals,
-		Symptoms:       symptoms,
+		MealOptions:         mealOptions,
+		UnitOptions:         unitOptions,
+		SymptomOptions:      symptomOptions,
+		Now:                 time.Now().Format("2006-01-02T15:04"),
+		Meals:               meals,
+		MealTemplates:       mealTemplates,
+		Symptoms:            symptoms,
+		Medications:         medications,
+		MedicationOptions:   medicationOptions,
+		Events:              events,
+		EventKinds:          eventKinds,
+		Stools:              stools,
+		BristolOptions:      bristolOptions(),
+		UrgencyOptions:      urgencyLevels,
+		Bristol:             defaultBristol,
+		CheckIn:             *checkIn,
+		CheckInMetrics:      checkInMetrics,
+		CheckInScores:       checkInScores,
+		MinSeverity:         minSeverity,
+		MaxSeverity:         maxSeverity,
+		Severity:            defaultSeverity,
+		Username:            currentUser(r).Username,
+		Profiles:            profiles,
+		EliminationProtocol: activeProtocol(protocols, today),
+		Trials:              activeTrials(trials),
+	}
+	if p := currentProfile(r); p != nil {
+		data.Profile = *p
 	}
 	if err := templates.ExecuteTemplate(w, "index.html", data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -175,21 +399,44 @@ func mealsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	items := r.FormValue("items")
-	timestampStr := r.FormValue("timestamp")
+	if err := parseUploadForm(w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := parseMealItemsForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	photos, err := readPhotos(uploadedPhotos(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// A photo of the plate can stand in for typing the items
+	if len(items) == 0 && len(photos) == 0 {
+		http.Error(w, "minst én matvare eller ett bilde må oppgis", http.StatusBadRequest)
+		return
+	}
 	note := r.FormValue("note")
 
-	// Parse the timestamp string as local time, then convert to UTC for storage
-	t, err := time.ParseInLocation(timestampFormat, timestampStr, time.Local)
+	// The form sends the wall-clock time and the browser's zone
+	t, tz, err := parseEntryTime(r.FormValue("timestamp"), r.FormValue("tz"))
 	if err != nil {
-		http.Error(w, "ugyldig tidspunkt", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err = db.Exec("INSERT INTO meals (items, timestamp, note) VALUES (?, ?, ?)", items, t.UTC().Format(time.RFC3339), note)
+	pid := currentProfileID(r)
+	id, err := insertMeal(pid, Meal{Items: items, Timestamp: t, TZ: tz, Note: note})
 	if err != nil {
 		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
 		return
 	}
+	if err := saveMealPhotos(id, photos); err != nil {
+		http.Error(w, "feil ved lagring av bilde", http.StatusInternalServerError)
+		return
+	}
+	recordRevision(pid, entityMeal, id, revCreate, channelWeb, nil)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -199,20 +446,31 @@ func symptomsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	description := r.FormValue("description")
-	timestampStr := r.FormValue("timestamp")
 	note := r.FormValue("note")
+	severity, err := parseSeverity(r.FormValue("severity"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Parse the timestamp string as local time, then convert to UTC for storage
-	t, err := time.ParseInLocation(timestampFormat, timestampStr, time.Local)
+	// The form sends the wall-clock time and the browser's zone
+	t, tz, err := parseEntryTime(r.FormValue("timestamp"), r.FormValue("tz"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endTime, ongoing, err := parseSymptomEnd(r, t)
 	if err != nil {
-		http.Error(w, "ugyldig tidspunkt", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err = db.Exec("INSERT INTO symptoms (description, timestamp, note) VALUES (?, ?, ?)", description, t.UTC().Format(time.RFC3339), note)
+	pid := currentProfileID(r)
+	id, err := insertSymptom(pid, Symptom{Description: description, Timestamp: t, TZ: tz, Note: note, Severity: severity, EndTimestamp: endTime, Ongoing: ongoing})
 	if err != nil {
 		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
 		return
 	}
+	recordRevision(pid, entitySymptom, id, revCreate, channelWeb, nil)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -223,26 +481,28 @@ func editMealHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	row := db.QueryRow("SELECT id, items, timestamp, note FROM meals WHERE id = ?", id)
-	var m Meal
-	var ts string
-	if err := row.Scan(&m.ID, &m.Items, &ts, &m.Note); err != nil {
+	pid := currentProfileID(r)
+	m, err := getMeal(pid, id)
+	if err == sql.ErrNoRows {
 		http.Error(w, "måltid ikke funnet", http.StatusNotFound)
 		return
 	}
-	t, err := parseRFC3339(ts) // This time is in UTC
 	if err != nil {
-		http.Error(w, "ugyldig tidspunkt", http.StatusInternalServerError)
+		http.Error(w, "kunne ikke hente måltid", http.StatusInternalServerError)
+		return
+	}
+	mealOptions, err := mealOptions(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
 		return
 	}
-	m.Timestamp = t
-	// InputTime will now be a UTC string that JS can parse and convert to local
-	m.InputTime = t.Format("2006-01-02T15:04:00Z") // Explicitly mark as UTC for JS parsing
 	data := struct {
 		MealOptions []string
+		UnitOptions []string
 		Meal        Meal
 	}{
-		MealOptions: []string{"Brød", "Melk", "Ost"},
+		MealOptions: mealOptions,
+		UnitOptions: unitOptions,
 		Meal:        m,
 	}
 	if err := templates.ExecuteTemplate(w, "edit_meal.html", data); err != nil {
@@ -256,33 +516,73 @@ func updateMealHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	id := r.FormValue("id")
-	items := r.FormValue("items")
-	timestampStr := r.FormValue("timestamp")
+	if err := parseUploadForm(w, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "ugyldig id", http.StatusBadRequest)
+		return
+	}
+	pid := currentProfileID(r)
+	before := entryBefore(pid, entityMeal, id)
+	if before == nil {
+		http.Error(w, "måltid ikke funnet", http.StatusNotFound)
+		return
+	}
+	items, err := parseMealItemsForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	photos, err := readPhotos(uploadedPhotos(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 && len(photos) == 0 {
+		existing, err := mealPhotoFilenames(id)
+		if err != nil {
+			http.Error(w, "kunne ikke hente bilder", http.StatusInternalServerError)
+			return
+		}
+		if len(existing) == 0 {
+			http.Error(w, "minst én matvare eller ett bilde må oppgis", http.StatusBadRequest)
+			return
+		}
+	}
 	note := r.FormValue("note")
-	// Parse the timestamp string as local time, then convert to UTC for storage
-	t, err := time.ParseInLocation(timestampFormat, timestampStr, time.Local)
+	// The edit form keeps the zone the meal was logged in
+	t, tz, err := parseEntryTime(r.FormValue("timestamp"), r.FormValue("tz"))
 	if err != nil {
-		http.Error(w, "ugyldig tidspunkt", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = updateMeal(pid, Meal{ID: id, Items: items, Timestamp: t, TZ: tz, Note: note})
+	if err == sql.ErrNoRows {
+		http.Error(w, "måltid ikke funnet", http.StatusNotFound)
 		return
 	}
-	_, err = db.Exec("UPDATE meals SET items = ?, timestamp = ?, note = ? WHERE id = ?", items, t.UTC().Format(time.RFC3339), note, id)
 	if err != nil {
 		http.Error(w, "feil ved oppdatering", http.StatusInternalServerError)
 		return
 	}
+	if err := saveMealPhotos(int64(id), photos); err != nil {
+		http.Error(w, "feil ved lagring av bilde", http.StatusInternalServerError)
+		return
+	}
+	recordRevision(pid, entityMeal, int64(id), revUpdate, channelWeb, before)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// deleteMealHandler deletes a meal entry.
+// deleteMealHandler moves a meal entry to the trash.
 func deleteMealHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	id := r.FormValue("id")
-	_, err := db.Exec("DELETE FROM meals WHERE id = ?", id)
-	if err != nil {
+	if err := trashEntry(currentProfileID(r), entityMeal, r.FormValue("id"), channelWeb); err != nil {
 		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
 		return
 	}
@@ -296,27 +596,31 @@ func editSymptomHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	row := db.QueryRow("SELECT id, description, timestamp, note FROM symptoms WHERE id = ?", id)
-	var s Symptom
-	var ts string
-	if err := row.Scan(&s.ID, &s.Description, &ts, &s.Note); err != nil {
+	pid := currentProfileID(r)
+	s, err := getSymptom(pid, id)
+	if err == sql.ErrNoRows {
 		http.Error(w, "symptom ikke funnet", http.StatusNotFound)
 		return
 	}
-	t, err := parseRFC3339(ts) // This time is in UTC
 	if err != nil {
 		http.Error(w, "ugyldig tidspunkt", http.StatusInternalServerError)
 		return
 	}
-	s.Timestamp = t
-	// InputTime will now be a UTC string that JS can parse and convert to local
-	s.InputTime = t.Format("2006-01-02T15:04:00Z") // Explicitly mark as UTC for JS parsing
+	symptomOptions, err := symptomOptions(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
 	data := struct {
 		SymptomOptions []string
 		Symptom        Symptom
+		MinSeverity    int
+		MaxSeverity    int
 	}{
-		SymptomOptions: []string{"Hodepine", "Kvalme", "Tretthet"},
+		SymptomOptions: symptomOptions,
 		Symptom:        s,
+		MinSeverity:    minSeverity,
+		MaxSeverity:    maxSeverity,
 	}
 	if err := templates.ExecuteTemplate(w, "edit_symptom.html", data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -329,125 +633,258 @@ func updateSymptomHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	id := r.FormValue("id")
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "ugyldig id", http.StatusBadRequest)
+		return
+	}
 	description := r.FormValue("description")
-	timestampStr := r.FormValue("timestamp")
 	note := r.FormValue("note")
-	// Parse the timestamp string as local time, then convert to UTC for storage
-	t, err := time.ParseInLocation(timestampFormat, timestampStr, time.Local)
+	severity, err := parseSeverity(r.FormValue("severity"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The edit form keeps the zone the symptom was logged in
+	t, tz, err := parseEntryTime(r.FormValue("timestamp"), r.FormValue("tz"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endTime, ongoing, err := parseSymptomEnd(r, t)
 	if err != nil {
-		http.Error(w, "ugyldig tidspunkt", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pid := currentProfileID(r)
+	before := entryBefore(pid, entitySymptom, id)
+	err = updateSymptom(pid, id, Symptom{Description: description, Timestamp: t, TZ: tz, Note: note, Severity: severity, EndTimestamp: endTime, Ongoing: ongoing})
+	if err == sql.ErrNoRows {
+		http.Error(w, "symptom ikke funnet", http.StatusNotFound)
 		return
 	}
-	_, err = db.Exec("UPDATE symptoms SET description = ?, timestamp = ?, note = ? WHERE id = ?", description, t.UTC().Format(time.RFC3339), note, id)
 	if err != nil {
 		http.Error(w, "feil ved oppdatering", http.StatusInternalServerError)
 		return
 	}
+	recordRevision(pid, entitySymptom, id, revUpdate, channelWeb, before)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// deleteSymptomHandler deletes a symptom entry.
-func deleteSymptomHandler(w http.ResponseWriter, r *http.Request) {
+// endSymptomHandler marks an ongoing symptom as ended now.
+func endSymptomHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
-	id := r.FormValue("id")
-	_, err := db.Exec("DELETE FROM symptoms WHERE id = ?", id)
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "ugyldig id", http.StatusBadRequest)
+		return
+	}
+	pid := currentProfileID(r)
+	before := entryBefore(pid, entitySymptom, id)
+	res, err := db.Exec("UPDATE symptoms SET end_timestamp = ?, ongoing = 0 WHERE id = ? AND profile_id = ? AND ongoing = 1 AND deleted_at IS NULL",
+		time.Now().UTC().Format(time.RFC3339), id, pid)
 	if err != nil {
+		http.Error(w, "feil ved oppdatering", http.StatusInternalServerError)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		recordRevision(pid, entitySymptom, id, revUpdate, channelWeb, before)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// deleteSymptomHandler moves a symptom entry to the trash.
+func deleteSymptomHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := trashEntry(currentProfileID(r), entitySymptom, r.FormValue("id"), channelWeb); err != nil {
 		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
 		return
 	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// parseAPIMealItems accepts meal items as a list where each entry is either a
+// name or an object with name, quantity and unit. For backwards compatibility,
+// a single comma-separated string is also accepted.
+func parseAPIMealItems(raw json.RawMessage) ([]MealItem, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var legacy string
+	if err := json.Unmarshal(raw, &legacy); err == nil {
+		var items []MealItem
+		for _, name := range splitMealItems(legacy) {
+			items = append(items, MealItem{Name: name})
+		}
+		return items, nil
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil, errors.New("items må være en liste med matvarer")
+	}
+	var items []MealItem
+	for _, entry := range entries {
+		var item MealItem
+		if err := json.Unmarshal(entry, &item.Name); err != nil {
+			if err := json.Unmarshal(entry, &item); err != nil {
+				return nil, errors.New("ugyldig matvare i items")
+			}
+		}
+		item.Name = strings.TrimSpace(item.Name)
+		if item.Name == "" {
+			continue
+		}
+		if item.Quantity != nil && *item.Quantity < 0 {
+			return nil, errors.New("ugyldig mengde")
+		}
+		if item.Quantity == nil {
+			item.Unit = ""
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseAPIMeal validates the fields of a meal sent to the API. Items can be
+// left out if the meal has photos.
+func parseAPIMeal(rawItems json.RawMessage, timestamp, tz, note string, hasPhotos bool) (Meal, error) {
+	items, err := parseAPIMealItems(rawItems)
+	if err != nil {
+		return Meal{}, err
+	}
+	if (len(items) == 0 && !hasPhotos) || strings.TrimSpace(timestamp) == "" {
+		return Meal{}, errors.New("items (eller photo) og timestamp må oppgis")
+	}
+	if _, err := loadEntryZone(tz); err != nil {
+		return Meal{}, errors.New("ugyldig tz, bruk et IANA-navn som Europe/Oslo eller en forskyvning som +02:00")
+	}
+	// The timestamp is wall-clock time in tz, or the server's zone if tz is
+	// omitted, unless it carries its own UTC offset
+	t, tz, err := parseEntryTime(timestamp, tz)
+	if err != nil {
+		return Meal{}, errors.New("ugyldig timestamp-format, bruk 2006-01-02T15:04 eller RFC3339")
+	}
+	return Meal{Items: items, Timestamp: t, TZ: tz, Note: note}, nil
+}
+
+// multipartItems converts the items field of a multipart request to the JSON
+// accepted by parseAPIMealItems. Values that are not JSON are treated as the
+// legacy comma-separated string.
+func multipartItems(v string) json.RawMessage {
+	if strings.TrimSpace(v) == "" {
+		return nil
+	}
+	if json.Valid([]byte(v)) {
+		return json.RawMessage(v)
+	}
+	raw, _ := json.Marshal(v)
+	return raw
+}
+
 func apiMealHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "kun POST er støttet", http.StatusMethodNotAllowed)
 		return
 	}
 	type MealInput struct {
-		Items     string `json:"items"`
-		Timestamp string `json:"timestamp"`
-		Note      string `json:"note"`
+		Items     json.RawMessage `json:"items"`
+		Timestamp string          `json:"timestamp"`
+		TZ        string          `json:"tz"`
+		Note      string          `json:"note"`
+		// Profile is the name of the profile to log the meal in, instead
+		// of the selected one
+		Profile string `json:"profile"`
 	}
 	var input MealInput
-	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+	var photos []photoUpload
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		// The multipart variant takes the same fields as form values, with
+		// items as JSON or a comma-separated string, plus "photo" files
+		if err := parseUploadForm(w, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		input.Items = multipartItems(r.FormValue("items"))
+		input.Timestamp = r.FormValue("timestamp")
+		input.TZ = r.FormValue("tz")
+		input.Note = r.FormValue("note")
+		input.Profile = r.FormValue("profile")
+		var err error
+		if photos, err = readPhotos(uploadedPhotos(r)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		http.Error(w, "ugyldig JSON", http.StatusBadRequest)
 		return
 	}
-	if strings.TrimSpace(input.Items) == "" || strings.TrimSpace(input.Timestamp) == "" {
-		http.Error(w, "items og timestamp må oppgis", http.StatusBadRequest)
-		return
-	}
-	// Parse the timestamp string as local time, then convert to UTC for storage
-	t, err := time.ParseInLocation(timestampFormat, input.Timestamp, time.Local)
+	meal, err := parseAPIMeal(input.Items, input.Timestamp, input.TZ, input.Note, len(photos) > 0)
 	if err != nil {
-		http.Error(w, "ugyldig timestamp-format, bruk 2006-01-02T15:04", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	res, err := db.Exec("INSERT INTO meals (items, timestamp, note) VALUES (?, ?, ?)", input.Items, t.UTC().Format(time.RFC3339), input.Note)
+	pid := currentProfileID(r)
+	if input.Profile != "" {
+		p, err := findProfileByName(currentUser(r).ID, input.Profile)
+		if err != nil {
+			http.Error(w, "kunne ikke hente profil", http.StatusInternalServerError)
+			return
+		}
+		if p == nil {
+			http.Error(w, "ukjent profil", http.StatusBadRequest)
+			return
+		}
+		pid = p.ID
+	}
+	id, err := insertMeal(pid, meal)
 	if err != nil {
 		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
 		return
 	}
-	id, _ := res.LastInsertId()
+	if err := saveMealPhotos(id, photos); err != nil {
+		http.Error(w, "feil ved lagring av bilde", http.StatusInternalServerError)
+		return
+	}
+	recordRevision(pid, entityMeal, id, revCreate, channelAPI, nil)
+	// The meal is saved either way, so a failed check only leaves out the
+	// warning
+	meals := []Meal{meal}
+	if err := flagProfileMeals(pid, meals); err != nil {
+		log.Printf("could not check meal %d against elimination protocols: %v", id, err)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(struct {
-		Status string `json:"status"`
-		ID     int64  `json:"id"`
+		Status     string   `json:"status"`
+		ID         int64    `json:"id"`
+		Violations []string `json:"violations,omitempty"`
 	}{
-		Status: "ok",
-		ID:     id,
+		Status:     "ok",
+		ID:         id,
+		Violations: meals[0].Violations,
 	})
 }
 
-// exportHandler exports all data as CSV or JSON.
-func exportHandler(w http.ResponseWriter, r *http.Request) {
-	format := r.URL.Query().Get("format")
-	meals, err := getAllMeals()
-	if err != nil {
-		http.Error(w, "kunne ikke hente måltider", http.StatusInternalServerError)
-		return
-	}
-	symptoms, err := getAllSymptoms()
+// timeSeriesPageHandler displays the time series visualization page.
+func timeSeriesPageHandler(w http.ResponseWriter, r *http.Request) {
+	kinds, err := getEventKinds(currentProfileID(r))
 	if err != nil {
-		http.Error(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
+		http.Error(w, "kunne ikke hente hendelsestyper", http.StatusInternalServerError)
 		return
 	}
-	switch format {
-	case "json":
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Content-Disposition", `attachment; filename="export.json"`)
-		data := struct {
-			Meals    []Meal    `json:"meals"`
-			Symptoms []Symptom `json:"symptoms"`
-		}{meals, symptoms}
-		if err := json.NewEncoder(w).Encode(data); err != nil {
-			http.Error(w, "feil ved eksport", http.StatusInternalServerError)
-		}
-	default:
-		w.Header().Set("Content-Type", "text/csv")
-		w.Header().Set("Content-Disposition", `attachment; filename="export.csv"`)
-		writer := csv.NewWriter(w)
-		defer writer.Flush()
-		writer.Write([]string{"type", "id", "value", "timestamp", "note"})
-		for _, m := range meals {
-			writer.Write([]string{"meal", strconv.Itoa(m.ID), m.Items, m.Timestamp.Format(time.RFC3339), m.Note})
-		}
-		for _, s := range symptoms {
-			writer.Write([]string{"symptom", strconv.Itoa(s.ID), s.Description, s.Timestamp.Format(time.RFC3339), s.Note})
-		}
-	}
-}
-
-// timeSeriesPageHandler displays the time series visualization page.
-func timeSeriesPageHandler(w http.ResponseWriter, r *http.Request) {
 	now := time.Now()
-	data := struct{ Start, End string }{
-		Start: now.AddDate(0, 0, -defaultTimeSeriesDays).Format(dateFormat),
-		End:   now.Format(dateFormat),
+	data := struct {
+		Start, End string
+		EventKinds []EventKind
+	}{
+		Start:      now.AddDate(0, 0, -defaultTimeSeriesDays).Format(dateFormat),
+		End:        now.Format(dateFormat),
+		EventKinds: kinds,
 	}
 	if err := templates.ExecuteTemplate(w, "timeseries.html", data); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -483,7 +920,10 @@ type DetailedTimeSeriesData struct {
 // Returns a slice of correlation values for lags from -maxLag to +maxLag.
 // (See analysis.go)
 
-// timeSeriesDataHandler returns JSON data for cross-correlation visualization
+// timeSeriesDataHandler returns JSON data for cross-correlation visualization.
+// All series share one minute grid over the UTC days from start to end, so
+// entries are selected by their UTC date rather than by the zone they were
+// logged in. The correlations depend only on the time between entries.
 func timeSeriesDataHandler(w http.ResponseWriter, r *http.Request) {
 	start := r.URL.Query().Get("start")
 	end := r.URL.Query().Get("end")
@@ -511,19 +951,32 @@ func timeSeriesDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all meals with their items in the date range
+	// Meal items give impulses of 1, or of their quantity if amplitude=quantity
+	useQuantity := r.URL.Query().Get("amplitude") == "quantity"
+	// Meal items can be grouped through the food catalog, see newFoodGrouper
+	groupsOf, err := newFoodGrouper(currentProfileID(r), r.URL.Query().Get("group"), parseGroupLevel(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get all of the profile's meal items in the UTC date range
+	pid := currentProfileID(r)
 	mealRows, err := db.Query(
-		"SELECT timestamp, items FROM meals WHERE DATE(timestamp) BETWEEN ? AND ? ORDER BY timestamp ASC", start, end)
+		`SELECT m.timestamp, i.name, i.quantity, i.unit FROM meals m JOIN meal_items i ON i.meal_id = m.id
+		WHERE m.profile_id = ? AND m.deleted_at IS NULL AND DATE(m.timestamp) BETWEEN ? AND ? ORDER BY m.timestamp ASC`, pid, start, end)
 	if err != nil {
 		http.Error(w, "kunne ikke hente måltider", http.StatusInternalServerError)
 		return
 	}
 	defer mealRows.Close()
 
-	mealsByType := make(map[string][]time.Time)
+	mealsByType := make(map[string][]seriesEvent)
 	for mealRows.Next() {
-		var ts, items string
-		if err := mealRows.Scan(&ts, &items); err != nil {
+		var ts, item string
+		var quantity sql.NullFloat64
+		var unit sql.NullString
+		if err := mealRows.Scan(&ts, &item, &quantity, &unit); err != nil {
 			http.Error(w, "feil ved scanning", http.StatusInternalServerError)
 			return
 		}
@@ -531,29 +984,40 @@ func timeSeriesDataHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			continue
 		}
-		// Split items by comma and create separate entries for each
-		itemList := strings.Split(items, ",")
-		for _, item := range itemList {
-			item = strings.TrimSpace(item)
-			if item != "" {
-				mealsByType[item] = append(mealsByType[item], t)
+		e := seriesEvent{Start: t, Value: 1}
+		suffix := ""
+		if useQuantity && quantity.Valid {
+			e.Value = quantity.Float64
+			// Quantities in different units are not comparable
+			if unit.String != "" {
+				suffix = " [" + unit.String + "]"
 			}
 		}
+		for _, group := range groupsOf(item) {
+			mealsByType[group+suffix] = append(mealsByType[group+suffix], e)
+		}
 	}
 
-	// Get all symptoms with their descriptions in the date range
+	// Get all symptoms active in the UTC date range, with their severities.
+	// Ongoing symptoms last until now.
 	symptomRows, err := db.Query(
-		"SELECT timestamp, description FROM symptoms WHERE DATE(timestamp) BETWEEN ? AND ? ORDER BY timestamp ASC", start, end)
+		`SELECT timestamp, end_timestamp, ongoing, description, severity FROM symptoms
+		WHERE profile_id = ? AND deleted_at IS NULL AND DATE(timestamp) <= ? AND (DATE(COALESCE(end_timestamp, timestamp)) >= ? OR ongoing = 1)
+		ORDER BY timestamp ASC`, pid, end, start)
 	if err != nil {
 		http.Error(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
 		return
 	}
 	defer symptomRows.Close()
 
-	symptomsByType := make(map[string][]time.Time)
+	now := time.Now()
+	symptomsByType := make(map[string][]seriesEvent)
 	for symptomRows.Next() {
 		var ts, description string
-		if err := symptomRows.Scan(&ts, &description); err != nil {
+		var endTs sql.NullString
+		var ongoing bool
+		var severity int
+		if err := symptomRows.Scan(&ts, &endTs, &ongoing, &description, &severity); err != nil {
 			http.Error(w, "feil ved scanning", http.StatusInternalServerError)
 			return
 		}
@@ -561,63 +1025,68 @@ func timeSeriesDataHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			continue
 		}
-		symptomsByType[description] = append(symptomsByType[description], t)
-	}
-
-	// Create maps for quick lookup of event times by type (rounded to minute)
-	// Use UTC format for consistency
-	const minuteKeyFormat = "2006-01-02T15:04Z" // Explicitly UTC
-	mealMinutesByType := make(map[string]map[string]bool)
-	for mealType, times := range mealsByType {
-		mealMinutesByType[mealType] = make(map[string]bool)
-		for _, t := range times {
-			minuteKey := t.UTC().Format(minuteKeyFormat) // Use UTC time for key
-			mealMinutesByType[mealType][minuteKey] = true
-		}
-	}
-
-	symptomMinutesByType := make(map[string]map[string]bool)
-	for symptomType, times := range symptomsByType {
-		symptomMinutesByType[symptomType] = make(map[string]bool)
-		for _, t := range times {
-			minuteKey := t.UTC().Format(minuteKeyFormat) // Use UTC time for key
-			symptomMinutesByType[symptomType][minuteKey] = true
+		// Symptoms use their severity as amplitude over the whole active interval
+		e := seriesEvent{Start: t, Value: float64(severity)}
+		if ongoing {
+			e.End = now
+		} else if endTs.Valid {
+			if et, err := parseRFC3339(endTs.String); err == nil {
+				e.End = et
+			}
 		}
+		symptomsByType[description] = append(symptomsByType[description], e)
 	}
 
-	// Generate time series for each minute in the date range
-	mealRawSeries := make(map[string][]int)
-	symptomRawSeries := make(map[string][]int)
-
-	// Iterate minute by minute in UTC
-	current := time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, time.UTC)
+	// Generate time series for each minute in the date range, in UTC
+	origin := time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, time.UTC)
 	endUTC := time.Date(endDate.Year(), endDate.Month(), endDate.Day(), 23, 59, 0, 0, time.UTC)
+	minutes := int(endUTC.Sub(origin).Minutes()) + 1
 
-	for !current.After(endUTC) {
-		timeStr := current.Format(minuteKeyFormat) // Format in UTC
-
-		for mealType := range mealsByType {
-			if mealRawSeries[mealType] == nil {
-				mealRawSeries[mealType] = []int{}
-			}
-			value := 0
-			if mealMinutesByType[mealType][timeStr] {
-				value = 1
-			}
-			mealRawSeries[mealType] = append(mealRawSeries[mealType], value)
+	mealRawSeries := make(map[string][]float64)
+	for mealType, events := range mealsByType {
+		mealRawSeries[mealType] = minuteSeries(events, origin, minutes)
+	}
+	// Medications can be included as extra input series, since they often
+	// mask or cause symptoms
+	if r.URL.Query().Get("medications") == "1" {
+		medicationsByName, err := queryMedicationEvents(pid, start, end)
+		if err != nil {
+			http.Error(w, "kunne ikke hente medisiner", http.StatusInternalServerError)
+			return
 		}
-
-		for symptomType := range symptomsByType {
-			if symptomRawSeries[symptomType] == nil {
-				symptomRawSeries[symptomType] = []int{}
-			}
-			value := 0
-			if symptomMinutesByType[symptomType][timeStr] {
-				value = 1
-			}
-			symptomRawSeries[symptomType] = append(symptomRawSeries[symptomType], value)
+		for name, events := range medicationsByName {
+			mealRawSeries[medicationSeriesPrefix+name] = minuteSeries(events, origin, minutes)
+		}
+	}
+	// Lifestyle events can be included as input series (events=<kind IDs>)
+	// or adjusted for as confounders (confounders=<kind IDs>)
+	inputEvents, err := queryKindEvents(pid, start, end, parseIDList(r.URL.Query().Get("events")))
+	if err != nil {
+		http.Error(w, "kunne ikke hente hendelser", http.StatusInternalServerError)
+		return
+	}
+	for name, events := range inputEvents {
+		mealRawSeries[eventSeriesPrefix+name] = minuteSeries(events, origin, minutes)
+	}
+	confounderEvents, err := queryKindEvents(pid, start, end, parseIDList(r.URL.Query().Get("confounders")))
+	if err != nil {
+		http.Error(w, "kunne ikke hente hendelser", http.StatusInternalServerError)
+		return
+	}
+	symptomRawSeries := make(map[string][]float64)
+	for symptomType, events := range symptomsByType {
+		symptomRawSeries[symptomType] = minuteSeries(events, origin, minutes)
+	}
+	// Loose and hard stools can be included as extra outcome series
+	if r.URL.Query().Get("stools") == "1" {
+		stoolsBySeries, err := queryStoolEvents(pid, start, end)
+		if err != nil {
+			http.Error(w, "kunne ikke hente avføringslogg", http.StatusInternalServerError)
+			return
+		}
+		for name, events := range stoolsBySeries {
+			symptomRawSeries[name] = minuteSeries(events, origin, minutes)
 		}
-		current = current.Add(time.Minute)
 	}
 
 	// Filtrer seriene
@@ -629,6 +1098,20 @@ func timeSeriesDataHandler(w http.ResponseWriter, r *http.Request) {
 	for symptomType, raw := range symptomRawSeries {
 		symptomFiltered[symptomType] = lowPassFilter(raw, tau)
 	}
+	// Adjust for confounders by removing their linear influence from both
+	// the input and the symptom series before correlating them
+	if len(confounderEvents) > 0 {
+		var confounders [][]float64
+		for _, events := range confounderEvents {
+			confounders = append(confounders, lowPassFilter(minuteSeries(events, origin, minutes), tau))
+		}
+		for mealType, series := range mealFiltered {
+			mealFiltered[mealType] = regressOut(series, confounders)
+		}
+		for symptomType, series := range symptomFiltered {
+			symptomFiltered[symptomType] = regressOut(series, confounders)
+		}
+	}
 
 	// Krysskorrelasjon mellom hver måltidstype og symptomtype
 	maxLag := defaultMaxLagHours * 60 // convert hours to minutes
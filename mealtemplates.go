@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MealTemplate is a saved meal that can be logged again at the current time.
+type MealTemplate struct {
+	ID    int        `json:"id"`
+	Name  string     `json:"name"`
+	Items []MealItem `json:"items"`
+	Note  string     `json:"note"`
+}
+
+// ItemsText returns the template's items as a comma-separated list.
+func (t MealTemplate) ItemsText() string {
+	return Meal{Items: t.Items}.ItemsText()
+}
+
+// meal returns a new meal from the template, logged at the given time and
+// zone.
+func (t MealTemplate) meal(at time.Time, tz string) Meal {
+	return Meal{Items: t.Items, Timestamp: at, TZ: tz, Note: t.Note}
+}
+
+// getMealTemplates returns all of a profile's meal templates with their items,
+// by name.
+func getMealTemplates(profileID int64) ([]MealTemplate, error) {
+	rows, err := db.Query("SELECT id, name, note FROM meal_templates WHERE profile_id = ? ORDER BY name COLLATE NOCASE", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var mealTemplates []MealTemplate
+	byID := make(map[int]int)
+	for rows.Next() {
+		var t MealTemplate
+		if err := rows.Scan(&t.ID, &t.Name, &t.Note); err != nil {
+			return nil, err
+		}
+		byID[t.ID] = len(mealTemplates)
+		mealTemplates = append(mealTemplates, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	itemRows, err := db.Query(`SELECT i.template_id, i.name, i.quantity, i.unit FROM meal_template_items i
+		JOIN meal_templates t ON t.id = i.template_id WHERE t.profile_id = ? ORDER BY i.template_id, i.position`, profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+	for itemRows.Next() {
+		var templateID int
+		var item MealItem
+		var quantity sql.NullFloat64
+		var unit sql.NullString
+		if err := itemRows.Scan(&templateID, &item.Name, &quantity, &unit); err != nil {
+			return nil, err
+		}
+		if quantity.Valid {
+			item.Quantity = &quantity.Float64
+		}
+		item.Unit = unit.String
+		if i, ok := byID[templateID]; ok {
+			mealTemplates[i].Items = append(mealTemplates[i].Items, item)
+		}
+	}
+	return mealTemplates, itemRows.Err()
+}
+
+// findMealTemplate returns the first of a profile's templates for which match
+// returns true, or nil if there is none.
+func findMealTemplate(profileID int64, match func(MealTemplate) bool) (*MealTemplate, error) {
+	mealTemplates, err := getMealTemplates(profileID)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range mealTemplates {
+		if match(t) {
+			return &t, nil
+		}
+	}
+	return nil, nil
+}
+
+// saveMealTemplate stores a profile's template, replacing the items and note of
+// the profile's existing template with the same name.
+func saveMealTemplate(profileID int64, t MealTemplate) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO meal_templates (profile_id, name, note) VALUES (?, ?, ?)
+		ON CONFLICT(profile_id, name) DO UPDATE SET note = excluded.note`, profileID, t.Name, t.Note)
+	if err != nil {
+		return err
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM meal_templates WHERE profile_id = ? AND name = ?", profileID, t.Name).Scan(&id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM meal_template_items WHERE template_id = ?", id); err != nil {
+		return err
+	}
+	for i, item := range t.Items {
+		var quantity interface{}
+		if item.Quantity != nil {
+			quantity = *item.Quantity
+		}
+		if _, err := tx.Exec("INSERT INTO meal_template_items (template_id, name, position, quantity, unit) VALUES (?, ?, ?, ?, ?)",
+			id, item.Name, i, quantity, item.Unit); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// quickLogTime is the time meals logged from a template or repeated are
+// stored with, at minute precision like the forms.
+func quickLogTime() time.Time {
+	return time.Now().Truncate(time.Minute)
+}
+
+// quickLogZone returns the zone sent with a quick-log request, or fallback
+// if none was sent.
+func quickLogZone(r *http.Request, fallback string) (string, error) {
+	tz := r.FormValue("tz")
+	if tz == "" {
+		return fallback, nil
+	}
+	_, err := loadEntryZone(tz)
+	return tz, err
+}
+
+// mealTemplatesHandler lists the meal templates and saves new ones. Saving a
+// template with an existing name replaces it.
+func mealTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	pid := currentProfileID(r)
+	if r.Method == http.MethodPost {
+		items, err := parseMealItemsForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t := MealTemplate{Name: strings.TrimSpace(r.FormValue("name")), Items: items, Note: r.FormValue("note")}
+		if t.Name == "" || len(t.Items) == 0 {
+			http.Error(w, "navn og minst én matvare må oppgis", http.StatusBadRequest)
+			return
+		}
+		if err := saveMealTemplate(pid, t); err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/meals/templates", http.StatusSeeOther)
+		return
+	}
+	mealTemplates, err := getMealTemplates(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente maler", http.StatusInternalServerError)
+		return
+	}
+	mealOptions, err := mealOptions(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		MealTemplates []MealTemplate
+		MealOptions   []string
+		UnitOptions   []string
+	}{mealTemplates, mealOptions, unitOptions}
+	if err := templates.ExecuteTemplate(w, "meal_templates.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// deleteMealTemplateHandler deletes a meal template. Meals logged from it
+// are kept.
+func deleteMealTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/meals/templates", http.StatusSeeOther)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM meal_templates WHERE id = ? AND profile_id = ?", r.FormValue("id"), currentProfileID(r)); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/meals/templates", http.StatusSeeOther)
+}
+
+// logMealTemplateHandler logs a meal from a template at the current time.
+func logMealTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	pid, id := currentProfileID(r), r.FormValue("id")
+	t, err := findMealTemplate(pid, func(t MealTemplate) bool { return strconv.Itoa(t.ID) == id })
+	if err != nil {
+		http.Error(w, "kunne ikke hente maler", http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		http.Error(w, "mal ikke funnet", http.StatusNotFound)
+		return
+	}
+	tz, err := quickLogZone(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mealID, err := insertMeal(pid, t.meal(quickLogTime(), tz))
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	recordRevision(pid, entityMeal, mealID, revCreate, channelWeb, nil)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// repeatMealHandler logs a copy of an existing meal's items and note at the
+// current time. Photos are not copied.
+func repeatMealHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	pid := currentProfileID(r)
+	m, err := getMeal(pid, r.FormValue("id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "måltid ikke funnet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "kunne ikke hente måltid", http.StatusInternalServerError)
+		return
+	}
+	if len(m.Items) == 0 {
+		http.Error(w, "måltidet har ingen matvarer å gjenta", http.StatusBadRequest)
+		return
+	}
+	// Without a zone from the browser, the copy keeps the original's zone
+	tz, err := quickLogZone(r, m.TZ)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := insertMeal(pid, Meal{Items: m.Items, Timestamp: quickLogTime(), TZ: tz, Note: m.Note})
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	recordRevision(pid, entityMeal, id, revCreate, channelWeb, nil)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// apiMealTemplateHandler logs the template named in the path,
+// /api/meal/template/{name}, at the current time. An optional tz parameter
+// sets the zone of the logged meal.
+func apiMealTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "kun POST er støttet", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/meal/template/"))
+	if name == "" || strings.Contains(name, "/") {
+		http.Error(w, "malnavn må oppgis", http.StatusBadRequest)
+		return
+	}
+	pid := currentProfileID(r)
+	t, err := findMealTemplate(pid, func(t MealTemplate) bool { return strings.EqualFold(t.Name, name) })
+	if err != nil {
+		http.Error(w, "kunne ikke hente maler", http.StatusInternalServerError)
+		return
+	}
+	if t == nil {
+		http.Error(w, "mal ikke funnet", http.StatusNotFound)
+		return
+	}
+	tz, err := quickLogZone(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := insertMeal(pid, t.meal(quickLogTime(), tz))
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	recordRevision(pid, entityMeal, id, revCreate, channelAPI, nil)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Status string `json:"status"`
+		ID     int64  `json:"id"`
+	}{
+		Status: "ok",
+		ID:     id,
+	})
+}
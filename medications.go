@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Medication represents a medication or supplement taken.
+type Medication struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Dose      string    `json:"dose"`
+	Timestamp time.Time `json:"timestamp"`
+	// TZ is the IANA zone or UTC offset the medication was logged in. Empty
+	// means the server's zone.
+	TZ          string `json:"tz,omitempty"`
+	Note        string `json:"note"`
+	DisplayTime string `json:"-"`
+	InputTime   string `json:"-"`
+}
+
+// medicationColumns lists the columns read by scanMedicationRow, in order.
+const medicationColumns = "id, name, dose, timestamp, tz, note"
+
+// scanMedicationRow scans a database row into a Medication struct.
+func scanMedicationRow(rows rowScanner) (Medication, error) {
+	var m Medication
+	var ts string
+	if err := rows.Scan(&m.ID, &m.Name, &m.Dose, &ts, &m.TZ, &m.Note); err != nil {
+		return m, err
+	}
+	t, err := parseRFC3339(ts)
+	if err != nil {
+		return m, err
+	}
+	// Times are shown as the wall-clock time where the medication was logged
+	m.Timestamp = t.In(entryLocation(m.TZ))
+	m.DisplayTime = m.Timestamp.Format(displayFormat)
+	m.InputTime = m.Timestamp.Format(timestampFormat)
+	return m, nil
+}
+
+// getAllMedications retrieves all of a profile's medications from the database.
+func getAllMedications(profileID int64) ([]Medication, error) {
+	rows, err := db.Query("SELECT "+medicationColumns+" FROM medications WHERE profile_id = ? ORDER BY timestamp DESC", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var medications []Medication
+	for rows.Next() {
+		m, err := scanMedicationRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		medications = append(medications, m)
+	}
+	return medications, rows.Err()
+}
+
+// medicationNames returns the distinct names of a profile's previously logged
+// medications.
+func medicationNames(profileID int64) ([]string, error) {
+	rows, err := db.Query("SELECT DISTINCT name FROM medications WHERE profile_id = ? ORDER BY name COLLATE NOCASE", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func medicationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	dose := strings.TrimSpace(r.FormValue("dose"))
+	timestampStr := r.FormValue("timestamp")
+	note := r.FormValue("note")
+	if name == "" {
+		http.Error(w, "navn må oppgis", http.StatusBadRequest)
+		return
+	}
+
+	// The form sends the wall-clock time and the browser's zone
+	t, tz, err := parseEntryTime(timestampStr, r.FormValue("tz"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("INSERT INTO medications (profile_id, name, dose, timestamp, tz, note) VALUES (?, ?, ?, ?, ?, ?)",
+		currentProfileID(r), name, dose, t.UTC().Format(time.RFC3339), tz, note)
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// editMedicationHandler displays a form to edit an existing medication entry.
+func editMedicationHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	pid := currentProfileID(r)
+	m, err := scanMedicationRow(db.QueryRow("SELECT "+medicationColumns+" FROM medications WHERE id = ? AND profile_id = ?", id, pid))
+	if err == sql.ErrNoRows {
+		http.Error(w, "medisin ikke funnet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "kunne ikke hente medisin", http.StatusInternalServerError)
+		return
+	}
+	options, err := medicationNames(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente medisiner", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		MedicationOptions []string
+		Medication        Medication
+	}{
+		MedicationOptions: options,
+		Medication:        m,
+	}
+	if err := templates.ExecuteTemplate(w, "edit_medication.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// updateMedicationHandler processes the medication update form.
+func updateMedicationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	id := r.FormValue("id")
+	name := strings.TrimSpace(r.FormValue("name"))
+	dose := strings.TrimSpace(r.FormValue("dose"))
+	timestampStr := r.FormValue("timestamp")
+	note := r.FormValue("note")
+	if name == "" {
+		http.Error(w, "navn må oppgis", http.StatusBadRequest)
+		return
+	}
+	// The form sends the wall-clock time in the zone the medication was logged in
+	t, tz, err := parseEntryTime(timestampStr, r.FormValue("tz"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("UPDATE medications SET name = ?, dose = ?, timestamp = ?, tz = ?, note = ? WHERE id = ? AND profile_id = ?",
+		name, dose, t.UTC().Format(time.RFC3339), tz, note, id, currentProfileID(r))
+	if err != nil {
+		http.Error(w, "feil ved oppdatering", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// deleteMedicationHandler deletes a medication entry.
+func deleteMedicationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	id := r.FormValue("id")
+	_, err := db.Exec("DELETE FROM medications WHERE id = ? AND profile_id = ?", id, currentProfileID(r))
+	if err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// queryMedicationEvents returns a profile's medication intakes within a UTC
+// date range as impulses keyed by medication name, for use as input series
+// in analysis.
+func queryMedicationEvents(profileID int64, start, end string) (map[string][]seriesEvent, error) {
+	rows, err := db.Query(
+		"SELECT timestamp, name FROM medications WHERE profile_id = ? AND DATE(timestamp) BETWEEN ? AND ? ORDER BY timestamp ASC", profileID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make(map[string][]seriesEvent)
+	for rows.Next() {
+		var ts, name string
+		if err := rows.Scan(&ts, &name); err != nil {
+			return nil, err
+		}
+		t, err := parseRFC3339(ts)
+		if err != nil {
+			continue
+		}
+		events[name] = append(events[name], seriesEvent{Start: t, Value: 1})
+	}
+	return events, rows.Err()
+}
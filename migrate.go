@@ -6,10 +6,18 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
-// migrate runs all SQL migration files in migrations/ directory.
+// migrate runs all SQL migration files in migrations/ directory that have not
+// been applied yet. Applied migrations are recorded in schema_migrations.
 func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
 	entries, err := os.ReadDir("migrations")
 	if err != nil {
 		return err
@@ -23,12 +31,32 @@ func migrate(db *sql.DB) error {
 	}
 	sort.Strings(files)
 	for _, fname := range files {
+		var applied int
+		if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE name = ?", fname).Scan(&applied); err != nil {
+			return err
+		}
+		if applied > 0 {
+			continue
+		}
 		path := filepath.Join("migrations", fname)
 		content, err := os.ReadFile(path)
 		if err != nil {
 			return err
 		}
-		if _, err := db.Exec(string(content)); err != nil {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(content)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)",
+			fname, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// inMigrationDir runs the test in a temporary directory holding the given
+// migration files, and returns a database opened there.
+func inMigrationDir(t *testing.T, files map[string]string) *sql.DB {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "migrations"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, "migrations", name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrateRunsEachFileOnce(t *testing.T) {
+	db := inMigrationDir(t, map[string]string{
+		"0001_create.sql": `-- A comment; with a semicolon
+CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT NOT NULL);
+INSERT INTO notes (body) VALUES ('first; still first');
+INSERT INTO notes (body) VALUES ('it''s second;');`,
+		"0002_add.sql": "ALTER TABLE notes ADD COLUMN tag TEXT NOT NULL DEFAULT 'a;b';",
+		"README.txt":   "not a migration",
+	})
+	for run := 1; run <= 2; run++ {
+		if err := migrate(db); err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+	}
+
+	rows, err := db.Query("SELECT body, tag FROM notes ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got [][2]string
+	for rows.Next() {
+		var body, tag string
+		if err := rows.Scan(&body, &tag); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, [2]string{body, tag})
+	}
+	want := [][2]string{{"first; still first", "a;b"}, {"it's second;", "a;b"}}
+	if len(got) != len(want) {
+		t.Fatalf("notes = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("note %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	var applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != 2 {
+		t.Errorf("applied migrations = %d, want 2", applied)
+	}
+}
+
+func TestMigrateRollsBackFailedFile(t *testing.T) {
+	db := inMigrationDir(t, map[string]string{
+		"0001_create.sql": "CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT NOT NULL);",
+		"0002_broken.sql": "INSERT INTO notes (body) VALUES ('kept?');\nINSERT INTO missing (body) VALUES ('x');",
+	})
+	if err := migrate(db); err == nil {
+		t.Fatal("migrate succeeded with a broken migration")
+	}
+
+	var notes, applied int
+	if err := db.QueryRow("SELECT COUNT(*) FROM notes").Scan(&notes); err != nil {
+		t.Fatal(err)
+	}
+	if notes != 0 {
+		t.Errorf("notes = %d, want 0 after rollback", notes)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE name = '0002_broken.sql'").Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != 0 {
+		t.Error("broken migration was recorded as applied")
+	}
+}
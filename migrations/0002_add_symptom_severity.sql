@@ -0,0 +1,2 @@
+-- Add severity (0-10) to symptoms; existing entries get a moderate default
+ALTER TABLE symptoms ADD COLUMN severity INTEGER NOT NULL DEFAULT 5;
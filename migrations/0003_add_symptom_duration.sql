@@ -0,0 +1,3 @@
+-- Symptoms can have an end time, or be marked as ongoing until closed
+ALTER TABLE symptoms ADD COLUMN end_timestamp TEXT;
+ALTER TABLE symptoms ADD COLUMN ongoing INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,27 @@
+-- Move comma-separated meals.items into a normalized meal_items table
+CREATE TABLE IF NOT EXISTS meal_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    meal_id INTEGER NOT NULL REFERENCES meals(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    position INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_meal_items_meal_id ON meal_items (meal_id);
+CREATE INDEX IF NOT EXISTS idx_meal_items_name ON meal_items (name COLLATE NOCASE);
+
+WITH RECURSIVE split(meal_id, item, rest, pos) AS (
+    SELECT id, NULL, items || ',', 0 FROM meals
+    UNION ALL
+    SELECT meal_id,
+           trim(substr(rest, 1, instr(rest, ',') - 1)),
+           substr(rest, instr(rest, ',') + 1),
+           pos + 1
+    FROM split
+    WHERE rest <> ''
+)
+INSERT INTO meal_items (meal_id, name, position)
+SELECT meal_id, item, ROW_NUMBER() OVER (PARTITION BY meal_id ORDER BY pos) - 1
+FROM split
+WHERE item IS NOT NULL AND item <> '';
+
+ALTER TABLE meals DROP COLUMN items;
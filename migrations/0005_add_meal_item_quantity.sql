@@ -0,0 +1,3 @@
+-- Optional portion size per meal item, e.g. 2 dl
+ALTER TABLE meal_items ADD COLUMN quantity REAL;
+ALTER TABLE meal_items ADD COLUMN unit TEXT;
@@ -0,0 +1,26 @@
+-- Food catalog with categories and allergen/FODMAP tags
+CREATE TABLE IF NOT EXISTS foods (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    category TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS food_tags (
+    food_id INTEGER NOT NULL REFERENCES foods(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (food_id, kind, tag)
+);
+
+-- Seed the catalog with the options that used to be hardcoded
+INSERT OR IGNORE INTO foods (name, category) VALUES
+    ('Brød', 'Gluten/korn'),
+    ('Melk', 'Meieri'),
+    ('Ost', 'Meieri');
+
+INSERT OR IGNORE INTO food_tags (food_id, kind, tag)
+SELECT id, 'allergen', 'Gluten' FROM foods WHERE name = 'Brød'
+UNION ALL SELECT id, 'fodmap', 'Fruktaner' FROM foods WHERE name = 'Brød'
+UNION ALL SELECT id, 'allergen', 'Melk' FROM foods WHERE name = 'Melk'
+UNION ALL SELECT id, 'fodmap', 'Laktose' FROM foods WHERE name = 'Melk'
+UNION ALL SELECT id, 'allergen', 'Melk' FROM foods WHERE name = 'Ost';
@@ -0,0 +1,2 @@
+-- Parent/child hierarchy in the food catalog, e.g. Meieri -> Ost -> Brie
+ALTER TABLE foods ADD COLUMN parent_id INTEGER REFERENCES foods(id) ON DELETE SET NULL;
@@ -0,0 +1,8 @@
+-- Medication and supplement log
+CREATE TABLE IF NOT EXISTS medications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL,
+    dose TEXT NOT NULL DEFAULT '',
+    timestamp TEXT NOT NULL,
+    note TEXT
+);
@@ -0,0 +1,25 @@
+-- User-defined lifestyle event kinds (sleep, exercise, stress, ...) and
+-- events of those kinds, each with an optional numeric value
+CREATE TABLE IF NOT EXISTS event_kinds (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    unit TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind_id INTEGER NOT NULL REFERENCES event_kinds(id) ON DELETE CASCADE,
+    timestamp TEXT NOT NULL,
+    end_timestamp TEXT,
+    value REAL,
+    note TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_kind_timestamp ON events(kind_id, timestamp);
+
+INSERT OR IGNORE INTO event_kinds (name, unit) VALUES
+    ('Søvn', 'timer'),
+    ('Trening', 'minutter'),
+    ('Stress', '1–10'),
+    ('Menstruasjon', ''),
+    ('Alkohol', 'enheter');
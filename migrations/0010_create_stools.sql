@@ -0,0 +1,10 @@
+-- Bowel movement log with Bristol Stool Scale type (1-7) and urgency (0-3)
+CREATE TABLE IF NOT EXISTS stools (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    timestamp TEXT NOT NULL,
+    bristol INTEGER NOT NULL CHECK (bristol BETWEEN 1 AND 7),
+    urgency INTEGER NOT NULL DEFAULT 0 CHECK (urgency BETWEEN 0 AND 3),
+    note TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_stools_timestamp ON stools(timestamp);
@@ -0,0 +1,11 @@
+-- Photos attached to meals. The image files are stored in the photos/
+-- directory next to data.db, with thumbnails in photos/thumbs/.
+CREATE TABLE IF NOT EXISTS meal_photos (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    meal_id INTEGER NOT NULL REFERENCES meals(id) ON DELETE CASCADE,
+    filename TEXT NOT NULL UNIQUE,
+    content_type TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_meal_photos_meal_id ON meal_photos(meal_id);
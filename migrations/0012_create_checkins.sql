@@ -0,0 +1,11 @@
+-- Once-per-day wellbeing check-in, keyed by local calendar date. All scores
+-- use a 1-5 scale.
+CREATE TABLE IF NOT EXISTS checkins (
+    date TEXT PRIMARY KEY,
+    wellbeing INTEGER NOT NULL CHECK (wellbeing BETWEEN 1 AND 5),
+    energy INTEGER NOT NULL CHECK (energy BETWEEN 1 AND 5),
+    mood INTEGER NOT NULL CHECK (mood BETWEEN 1 AND 5),
+    stress INTEGER NOT NULL CHECK (stress BETWEEN 1 AND 5),
+    note TEXT,
+    updated_at TEXT NOT NULL
+);
@@ -0,0 +1,8 @@
+-- User preferences for the suggestion lists: pinned favourites are always
+-- listed first, hidden entries are never suggested
+CREATE TABLE IF NOT EXISTS suggestion_prefs (
+    kind TEXT NOT NULL,
+    name TEXT NOT NULL COLLATE NOCASE,
+    state TEXT NOT NULL CHECK (state IN ('pinned', 'hidden')),
+    PRIMARY KEY (kind, name)
+);
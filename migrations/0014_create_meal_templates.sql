@@ -0,0 +1,17 @@
+-- Saved meals that can be logged again with one action
+CREATE TABLE IF NOT EXISTS meal_templates (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    note TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS meal_template_items (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    template_id INTEGER NOT NULL REFERENCES meal_templates(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    quantity REAL,
+    unit TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_meal_template_items_template_id ON meal_template_items(template_id);
@@ -0,0 +1,6 @@
+-- Deleted meals and symptoms are kept in the trash until purged
+ALTER TABLE meals ADD COLUMN deleted_at TEXT;
+ALTER TABLE symptoms ADD COLUMN deleted_at TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_meals_deleted_at ON meals (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_symptoms_deleted_at ON symptoms (deleted_at);
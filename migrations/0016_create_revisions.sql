@@ -0,0 +1,14 @@
+-- Every change to a meal or symptom, with JSON snapshots before and after.
+-- old_data is NULL for created entries.
+CREATE TABLE IF NOT EXISTS revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    entity TEXT NOT NULL CHECK (entity IN ('meal', 'symptom')),
+    entity_id INTEGER NOT NULL,
+    action TEXT NOT NULL CHECK (action IN ('create', 'update', 'delete', 'restore', 'revert')),
+    channel TEXT NOT NULL CHECK (channel IN ('web', 'api')),
+    old_data TEXT,
+    new_data TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_revisions_entity ON revisions (entity, entity_id);
@@ -0,0 +1,4 @@
+-- The zone each meal and symptom was logged in, as an IANA name or a UTC
+-- offset. Existing entries keep an empty zone, meaning the server's zone.
+ALTER TABLE meals ADD COLUMN tz TEXT NOT NULL DEFAULT '';
+ALTER TABLE symptoms ADD COLUMN tz TEXT NOT NULL DEFAULT '';
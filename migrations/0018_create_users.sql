@@ -0,0 +1,138 @@
+-- User accounts and login sessions. Sessions are stored by the SHA-256 hash
+-- of the cookie token, so a leaked database does not expose live sessions.
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL UNIQUE COLLATE NOCASE,
+    password_hash TEXT NOT NULL,
+    created_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TEXT NOT NULL,
+    expires_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
+
+-- Diary entries belong to a user. Entries logged before accounts existed
+-- have no owner and are claimed by the first user that registers.
+ALTER TABLE meals ADD COLUMN user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE symptoms ADD COLUMN user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE medications ADD COLUMN user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+ALTER TABLE stools ADD COLUMN user_id INTEGER REFERENCES users(id) ON DELETE CASCADE;
+
+-- Event kinds and foods were unique across the whole diary and are rebuilt
+-- to belong to a user, so that each account has its own kinds and catalog.
+-- Existing ones are claimed together with the entries. Events are rebuilt
+-- with the kinds and get their user_id column here.
+CREATE TABLE event_kinds_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL COLLATE NOCASE,
+    unit TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE events_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind_id INTEGER NOT NULL REFERENCES event_kinds_new(id) ON DELETE CASCADE,
+    timestamp TEXT NOT NULL,
+    end_timestamp TEXT,
+    value REAL,
+    note TEXT,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO event_kinds_new (id, name, unit) SELECT id, name, unit FROM event_kinds;
+INSERT INTO events_new (id, kind_id, timestamp, end_timestamp, value, note)
+    SELECT id, kind_id, timestamp, end_timestamp, value, note FROM events;
+-- Events go first, so that dropping the kinds does not cascade
+DROP TABLE events;
+DROP TABLE event_kinds;
+ALTER TABLE event_kinds_new RENAME TO event_kinds;
+ALTER TABLE events_new RENAME TO events;
+
+CREATE TABLE foods_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL COLLATE NOCASE,
+    category TEXT NOT NULL DEFAULT '',
+    parent_id INTEGER REFERENCES foods_new(id) ON DELETE SET NULL
+);
+CREATE TABLE food_tags_new (
+    food_id INTEGER NOT NULL REFERENCES foods_new(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (food_id, kind, tag)
+);
+INSERT INTO foods_new (id, name, category, parent_id) SELECT id, name, category, parent_id FROM foods;
+INSERT INTO food_tags_new (food_id, kind, tag) SELECT food_id, kind, tag FROM food_tags;
+-- Tags go first, so that dropping the foods does not cascade
+DROP TABLE food_tags;
+DROP TABLE foods;
+ALTER TABLE foods_new RENAME TO foods;
+ALTER TABLE food_tags_new RENAME TO food_tags;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_event_kinds_user_name ON event_kinds (user_id, name);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_foods_user_name ON foods (user_id, name);
+CREATE INDEX IF NOT EXISTS idx_events_kind_timestamp ON events(kind_id, timestamp);
+
+CREATE INDEX IF NOT EXISTS idx_meals_user_timestamp ON meals (user_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_symptoms_user_timestamp ON symptoms (user_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_medications_user_id ON medications (user_id);
+CREATE INDEX IF NOT EXISTS idx_events_user_id ON events (user_id);
+CREATE INDEX IF NOT EXISTS idx_stools_user_id ON stools (user_id);
+
+-- Check-ins, suggestion preferences and meal templates were unique across
+-- the whole diary and are rebuilt to be unique per user instead
+CREATE TABLE checkins_new (
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    date TEXT NOT NULL,
+    wellbeing INTEGER NOT NULL CHECK (wellbeing BETWEEN 1 AND 5),
+    energy INTEGER NOT NULL CHECK (energy BETWEEN 1 AND 5),
+    mood INTEGER NOT NULL CHECK (mood BETWEEN 1 AND 5),
+    stress INTEGER NOT NULL CHECK (stress BETWEEN 1 AND 5),
+    note TEXT,
+    updated_at TEXT NOT NULL,
+    UNIQUE (user_id, date)
+);
+INSERT INTO checkins_new (date, wellbeing, energy, mood, stress, note, updated_at)
+    SELECT date, wellbeing, energy, mood, stress, note, updated_at FROM checkins;
+DROP TABLE checkins;
+ALTER TABLE checkins_new RENAME TO checkins;
+
+CREATE TABLE suggestion_prefs_new (
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    name TEXT NOT NULL COLLATE NOCASE,
+    state TEXT NOT NULL CHECK (state IN ('pinned', 'hidden')),
+    UNIQUE (user_id, kind, name)
+);
+INSERT INTO suggestion_prefs_new (kind, name, state) SELECT kind, name, state FROM suggestion_prefs;
+DROP TABLE suggestion_prefs;
+ALTER TABLE suggestion_prefs_new RENAME TO suggestion_prefs;
+
+CREATE TABLE meal_templates_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL COLLATE NOCASE,
+    note TEXT NOT NULL DEFAULT '',
+    UNIQUE (user_id, name)
+);
+CREATE TABLE meal_template_items_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    template_id INTEGER NOT NULL REFERENCES meal_templates_new(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    quantity REAL,
+    unit TEXT
+);
+INSERT INTO meal_templates_new (id, name, note) SELECT id, name, note FROM meal_templates;
+INSERT INTO meal_template_items_new (id, template_id, name, position, quantity, unit)
+    SELECT id, template_id, name, position, quantity, unit FROM meal_template_items;
+-- Items go first, so that dropping the templates does not cascade
+DROP TABLE meal_template_items;
+DROP TABLE meal_templates;
+ALTER TABLE meal_templates_new RENAME TO meal_templates;
+ALTER TABLE meal_template_items_new RENAME TO meal_template_items;
+
+CREATE INDEX IF NOT EXISTS idx_meal_template_items_template_id ON meal_template_items(template_id);
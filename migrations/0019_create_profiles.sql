@@ -0,0 +1,114 @@
+-- Diary profiles, so that one account can keep separate diaries for several
+-- people, such as the children in a household. Entries, check-ins, meal
+-- templates, suggestion settings, event kinds and foods belong to a profile
+-- instead of directly to a user. Each existing user gets one profile with
+-- their username.
+CREATE TABLE IF NOT EXISTS profiles (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL COLLATE NOCASE,
+    created_at TEXT NOT NULL,
+    UNIQUE (user_id, name)
+);
+
+INSERT INTO profiles (user_id, name, created_at) SELECT id, username, created_at FROM users;
+
+-- The profile selected in each login session
+ALTER TABLE sessions ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE SET NULL;
+
+ALTER TABLE meals ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE;
+ALTER TABLE symptoms ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE;
+ALTER TABLE medications ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE;
+ALTER TABLE events ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE;
+ALTER TABLE stools ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE;
+ALTER TABLE event_kinds ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE;
+ALTER TABLE foods ADD COLUMN profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE;
+
+UPDATE meals SET profile_id = (SELECT p.id FROM profiles p WHERE p.user_id = meals.user_id);
+UPDATE symptoms SET profile_id = (SELECT p.id FROM profiles p WHERE p.user_id = symptoms.user_id);
+UPDATE medications SET profile_id = (SELECT p.id FROM profiles p WHERE p.user_id = medications.user_id);
+UPDATE events SET profile_id = (SELECT p.id FROM profiles p WHERE p.user_id = events.user_id);
+UPDATE stools SET profile_id = (SELECT p.id FROM profiles p WHERE p.user_id = stools.user_id);
+UPDATE event_kinds SET profile_id = (SELECT p.id FROM profiles p WHERE p.user_id = event_kinds.user_id);
+UPDATE foods SET profile_id = (SELECT p.id FROM profiles p WHERE p.user_id = foods.user_id);
+
+DROP INDEX idx_meals_user_timestamp;
+DROP INDEX idx_symptoms_user_timestamp;
+DROP INDEX idx_medications_user_id;
+DROP INDEX idx_events_user_id;
+DROP INDEX idx_stools_user_id;
+DROP INDEX idx_event_kinds_user_name;
+DROP INDEX idx_foods_user_name;
+
+ALTER TABLE meals DROP COLUMN user_id;
+ALTER TABLE symptoms DROP COLUMN user_id;
+ALTER TABLE medications DROP COLUMN user_id;
+ALTER TABLE events DROP COLUMN user_id;
+ALTER TABLE stools DROP COLUMN user_id;
+ALTER TABLE event_kinds DROP COLUMN user_id;
+ALTER TABLE foods DROP COLUMN user_id;
+
+CREATE INDEX IF NOT EXISTS idx_meals_profile_timestamp ON meals (profile_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_symptoms_profile_timestamp ON symptoms (profile_id, timestamp);
+CREATE INDEX IF NOT EXISTS idx_medications_profile_id ON medications (profile_id);
+CREATE INDEX IF NOT EXISTS idx_events_profile_id ON events (profile_id);
+CREATE INDEX IF NOT EXISTS idx_stools_profile_id ON stools (profile_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_event_kinds_profile_name ON event_kinds (profile_id, name);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_foods_profile_name ON foods (profile_id, name);
+
+-- Tables that are unique per user are rebuilt to be unique per profile
+CREATE TABLE checkins_new (
+    profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE,
+    date TEXT NOT NULL,
+    wellbeing INTEGER NOT NULL CHECK (wellbeing BETWEEN 1 AND 5),
+    energy INTEGER NOT NULL CHECK (energy BETWEEN 1 AND 5),
+    mood INTEGER NOT NULL CHECK (mood BETWEEN 1 AND 5),
+    stress INTEGER NOT NULL CHECK (stress BETWEEN 1 AND 5),
+    note TEXT,
+    updated_at TEXT NOT NULL,
+    UNIQUE (profile_id, date)
+);
+INSERT INTO checkins_new (profile_id, date, wellbeing, energy, mood, stress, note, updated_at)
+    SELECT (SELECT p.id FROM profiles p WHERE p.user_id = c.user_id), date, wellbeing, energy, mood, stress, note, updated_at
+    FROM checkins c;
+DROP TABLE checkins;
+ALTER TABLE checkins_new RENAME TO checkins;
+
+CREATE TABLE suggestion_prefs_new (
+    profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    name TEXT NOT NULL COLLATE NOCASE,
+    state TEXT NOT NULL CHECK (state IN ('pinned', 'hidden')),
+    UNIQUE (profile_id, kind, name)
+);
+INSERT INTO suggestion_prefs_new (profile_id, kind, name, state)
+    SELECT (SELECT p.id FROM profiles p WHERE p.user_id = s.user_id), kind, name, state FROM suggestion_prefs s;
+DROP TABLE suggestion_prefs;
+ALTER TABLE suggestion_prefs_new RENAME TO suggestion_prefs;
+
+CREATE TABLE meal_templates_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    profile_id INTEGER REFERENCES profiles(id) ON DELETE CASCADE,
+    name TEXT NOT NULL COLLATE NOCASE,
+    note TEXT NOT NULL DEFAULT '',
+    UNIQUE (profile_id, name)
+);
+CREATE TABLE meal_template_items_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    template_id INTEGER NOT NULL REFERENCES meal_templates_new(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    position INTEGER NOT NULL,
+    quantity REAL,
+    unit TEXT
+);
+INSERT INTO meal_templates_new (id, profile_id, name, note)
+    SELECT id, (SELECT p.id FROM profiles p WHERE p.user_id = t.user_id), name, note FROM meal_templates t;
+INSERT INTO meal_template_items_new (id, template_id, name, position, quantity, unit)
+    SELECT id, template_id, name, position, quantity, unit FROM meal_template_items;
+-- Items go first, so that dropping the templates does not cascade
+DROP TABLE meal_template_items;
+DROP TABLE meal_templates;
+ALTER TABLE meal_templates_new RENAME TO meal_templates;
+ALTER TABLE meal_template_items_new RENAME TO meal_template_items;
+
+CREATE INDEX IF NOT EXISTS idx_meal_template_items_template_id ON meal_template_items(template_id);
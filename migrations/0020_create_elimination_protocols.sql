@@ -0,0 +1,21 @@
+-- Elimination diet protocols: the foods are left out for a number of weeks
+-- from the start date, and then reintroduced one at a time in position
+-- order, each with a window of challenge_days days to watch for symptoms.
+CREATE TABLE IF NOT EXISTS elimination_protocols (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    profile_id INTEGER NOT NULL REFERENCES profiles(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    start_date TEXT NOT NULL,
+    elimination_weeks INTEGER NOT NULL CHECK (elimination_weeks > 0),
+    challenge_days INTEGER NOT NULL CHECK (challenge_days > 0),
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_elimination_protocols_profile_id ON elimination_protocols (profile_id);
+
+CREATE TABLE IF NOT EXISTS elimination_foods (
+    protocol_id INTEGER NOT NULL REFERENCES elimination_protocols(id) ON DELETE CASCADE,
+    name TEXT NOT NULL COLLATE NOCASE,
+    position INTEGER NOT NULL,
+    UNIQUE (protocol_id, name)
+);
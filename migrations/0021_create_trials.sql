@@ -0,0 +1,20 @@
+-- N-of-1 food challenge trials. Each day of a trial is randomly assigned to
+-- eating the food (challenge) or avoiding it (control) when the trial is
+-- planned, and the schedule is kept so that it can be followed and analysed.
+-- symptom limits the outcome to one kind of symptom; empty means all.
+CREATE TABLE IF NOT EXISTS trials (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    profile_id INTEGER NOT NULL REFERENCES profiles(id) ON DELETE CASCADE,
+    food TEXT NOT NULL,
+    symptom TEXT NOT NULL DEFAULT '',
+    created_at TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_trials_profile_id ON trials (profile_id);
+
+CREATE TABLE IF NOT EXISTS trial_days (
+    trial_id INTEGER NOT NULL REFERENCES trials(id) ON DELETE CASCADE,
+    date TEXT NOT NULL,
+    arm TEXT NOT NULL CHECK (arm IN ('challenge', 'control')),
+    UNIQUE (trial_id, date)
+);
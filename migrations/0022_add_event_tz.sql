@@ -0,0 +1,3 @@
+-- The zone each event was logged in, as for meals and symptoms. Existing
+-- events keep an empty zone, meaning the server's zone.
+ALTER TABLE events ADD COLUMN tz TEXT NOT NULL DEFAULT '';
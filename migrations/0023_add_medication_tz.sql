@@ -0,0 +1,3 @@
+-- The zone each medication was logged in, as for meals and symptoms.
+-- Existing medications keep an empty zone, meaning the server's zone.
+ALTER TABLE medications ADD COLUMN tz TEXT NOT NULL DEFAULT '';
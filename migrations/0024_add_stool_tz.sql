@@ -0,0 +1,3 @@
+-- The zone each stool was logged in, as for meals and symptoms. Existing
+-- stools keep an empty zone, meaning the server's zone.
+ALTER TABLE stools ADD COLUMN tz TEXT NOT NULL DEFAULT '';
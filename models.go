@@ -2,17 +2,39 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	// Symptom severity scale
+	minSeverity     = 0
+	maxSeverity     = 10
+	defaultSeverity = 5
+)
+
 // Meal represents a recorded meal entry.
 type Meal struct {
-	ID          int       `json:"id"`
-	Items       string    `json:"items"`
-	Timestamp   time.Time `json:"timestamp"`
-	Note        string    `json:"note"`
-	DisplayTime string    `json:"-"`
-	InputTime   string    `json:"-"`
+	ID        int        `json:"id"`
+	Items     []MealItem `json:"items"`
+	Timestamp time.Time  `json:"timestamp"`
+	// TZ is the IANA zone or UTC offset the meal was logged in. Empty means
+	// the server's zone.
+	TZ     string      `json:"tz,omitempty"`
+	Note   string      `json:"note"`
+	Photos []MealPhoto `json:"photos,omitempty"`
+	// DeletedAt is set for meals in the trash.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Violations are the items that break the elimination protocol active
+	// on the meal's date, if flagged
+	Violations  []string `json:"violations,omitempty"`
+	DisplayTime string   `json:"-"`
+	InputTime   string   `json:"-"`
 }
 
 // Symptom represents a recorded symptom entry.
@@ -20,50 +42,142 @@ type Symptom struct {
 	ID          int       `json:"id"`
 	Description string    `json:"description"`
 	Timestamp   time.Time `json:"timestamp"`
-	Note        string    `json:"note"`
-	DisplayTime string    `json:"-"`
-	InputTime   string    `json:"-"`
+	// TZ is the IANA zone or UTC offset the symptom was logged in. Empty
+	// means the server's zone.
+	TZ       string `json:"tz,omitempty"`
+	Note     string `json:"note"`
+	Severity int    `json:"severity"`
+	// EndTimestamp is nil if the symptom has no recorded end.
+	EndTimestamp *time.Time `json:"end_timestamp,omitempty"`
+	Ongoing      bool       `json:"ongoing"`
+	// DeletedAt is set for symptoms in the trash.
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	DisplayTime  string     `json:"-"`
+	InputTime    string     `json:"-"`
+	EndInputTime string     `json:"-"`
+}
+
+// MealItem is a single food in a meal, with an optional portion size.
+type MealItem struct {
+	Name     string   `json:"name"`
+	Quantity *float64 `json:"quantity,omitempty"`
+	Unit     string   `json:"unit,omitempty"`
+}
+
+// String returns the item name followed by its portion size, if any.
+func (i MealItem) String() string {
+	if i.Quantity == nil {
+		return i.Name
+	}
+	q := strconv.FormatFloat(*i.Quantity, 'f', -1, 64)
+	if i.Unit != "" {
+		q += " " + i.Unit
+	}
+	return i.Name + " (" + q + ")"
+}
+
+// QuantityText returns the quantity formatted for a form input.
+func (i MealItem) QuantityText() string {
+	if i.Quantity == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*i.Quantity, 'f', -1, 64)
+}
+
+// ItemNames returns the names of the meal's items in order.
+func (m Meal) ItemNames() []string {
+	names := make([]string, len(m.Items))
+	for i, item := range m.Items {
+		names[i] = item.Name
+	}
+	return names
+}
+
+// ItemsText returns the meal's items and portion sizes as a comma-separated
+// list for display.
+func (m Meal) ItemsText() string {
+	parts := make([]string, len(m.Items))
+	for i, item := range m.Items {
+		parts[i] = item.String()
+	}
+	return strings.Join(parts, ", ")
 }
 
-// scanMealRow scans a database row into a Meal struct.
-func scanMealRow(rows *sql.Rows) (Meal, error) {
+// mealColumns lists the columns read by scanMealRow, in order.
+const mealColumns = "id, timestamp, tz, note, deleted_at"
+
+// scanMealRow scans a database row into a Meal struct. Items are loaded
+// separately with loadMealItems.
+func scanMealRow(rows rowScanner) (Meal, error) {
 	var m Meal
 	var ts string
-	if err := rows.Scan(&m.ID, &m.Items, &ts, &m.Note); err != nil {
+	var deletedAt sql.NullString
+	if err := rows.Scan(&m.ID, &ts, &m.TZ, &m.Note, &deletedAt); err != nil {
 		return m, err
 	}
 	t, err := parseRFC3339(ts)
 	if err != nil {
 		return m, err
 	}
-	m.Timestamp = t
-	// DisplayTime is now set in main.go with a UTC string for client-side conversion
-	// m.DisplayTime = t.Format(displayFormat) // This line is no longer needed
-	m.InputTime = t.Local().Format(timestampFormat)
+	// Times are shown as the wall-clock time where the meal was logged
+	m.Timestamp = t.In(entryLocation(m.TZ))
+	if m.DeletedAt, err = parseNullableTimestamp(deletedAt); err != nil {
+		return m, err
+	}
+	m.DisplayTime = m.Timestamp.Format(displayFormat)
+	m.InputTime = m.Timestamp.Format(timestampFormat)
 	return m, nil
 }
 
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// symptomColumns lists the columns read by scanSymptomRow, in order.
+const symptomColumns = "id, description, timestamp, tz, note, severity, end_timestamp, ongoing, deleted_at"
+
 // scanSymptomRow scans a database row into a Symptom struct.
-func scanSymptomRow(rows *sql.Rows) (Symptom, error) {
+func scanSymptomRow(rows rowScanner) (Symptom, error) {
 	var s Symptom
 	var ts string
-	if err := rows.Scan(&s.ID, &s.Description, &ts, &s.Note); err != nil {
+	var endTs, deletedAt sql.NullString
+	if err := rows.Scan(&s.ID, &s.Description, &ts, &s.TZ, &s.Note, &s.Severity, &endTs, &s.Ongoing, &deletedAt); err != nil {
 		return s, err
 	}
 	t, err := parseRFC3339(ts)
 	if err != nil {
 		return s, err
 	}
-	s.Timestamp = t
-	// DisplayTime is now set in main.go with a UTC string for client-side conversion
-	// s.DisplayTime = t.Format(displayFormat) // This line is no longer needed
-	s.InputTime = t.Local().Format(timestampFormat)
+	loc := entryLocation(s.TZ)
+	s.Timestamp = t.In(loc)
+	if endTs.Valid {
+		et, err := parseRFC3339(endTs.String)
+		if err != nil {
+			return s, err
+		}
+		et = et.In(loc)
+		s.EndTimestamp = &et
+		s.EndInputTime = et.Format(timestampFormat)
+	}
+	if s.DeletedAt, err = parseNullableTimestamp(deletedAt); err != nil {
+		return s, err
+	}
+	s.DisplayTime = s.Timestamp.Format(displayFormat)
+	s.InputTime = s.Timestamp.Format(timestampFormat)
 	return s, nil
 }
 
-// getAllMeals retrieves all meals from the database.
-func getAllMeals() ([]Meal, error) {
-	rows, err := db.Query("SELECT id, items, timestamp, note FROM meals ORDER BY timestamp DESC")
+// getAllMeals retrieves all of a profile's meals from the database, except
+// those in the trash.
+func getAllMeals(profileID int64) ([]Meal, error) {
+	return queryMeals(profileID, "deleted_at IS NULL ORDER BY timestamp DESC")
+}
+
+// queryMeals retrieves a profile's meals matching a WHERE clause, with their
+// items and photos.
+func queryMeals(profileID int64, where string, args ...interface{}) ([]Meal, error) {
+	rows, err := db.Query("SELECT "+mealColumns+" FROM meals WHERE profile_id = ? AND "+where, append([]interface{}{profileID}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -76,12 +190,215 @@ func getAllMeals() ([]Meal, error) {
 		}
 		meals = append(meals, m)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := loadMealItems(meals); err != nil {
+		return nil, err
+	}
+	if err := loadMealPhotos(profileID, meals); err != nil {
+		return nil, err
+	}
 	return meals, nil
 }
 
-// getAllSymptoms retrieves all symptoms from the database.
-func getAllSymptoms() ([]Symptom, error) {
-	rows, err := db.Query("SELECT id, description, timestamp, note FROM symptoms ORDER BY timestamp DESC")
+// getMeal retrieves a single meal of a profile with its items. Meals in the
+// trash are not found.
+func getMeal(profileID int64, id interface{}) (Meal, error) {
+	m, err := scanMealRow(db.QueryRow("SELECT "+mealColumns+" FROM meals WHERE id = ? AND profile_id = ? AND deleted_at IS NULL", id, profileID))
+	if err != nil {
+		return m, err
+	}
+	meals := []Meal{m}
+	if err := loadMealItems(meals); err != nil {
+		return m, err
+	}
+	if err := loadMealPhotos(profileID, meals); err != nil {
+		return m, err
+	}
+	return meals[0], nil
+}
+
+// loadMealItems fills in the items of the given meals.
+func loadMealItems(meals []Meal) error {
+	if len(meals) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Meal, len(meals))
+	ids := make([]interface{}, len(meals))
+	for i := range meals {
+		byID[meals[i].ID] = &meals[i]
+		ids[i] = meals[i].ID
+	}
+	// Chunk the IN list to stay below SQLite's variable limit
+	const chunkSize = 500
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		rows, err := db.Query("SELECT meal_id, name, quantity, unit FROM meal_items WHERE meal_id IN (?"+
+			strings.Repeat(", ?", n-1)+") ORDER BY meal_id, position", ids[:n]...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var mealID int
+			var item MealItem
+			var quantity sql.NullFloat64
+			var unit sql.NullString
+			if err := rows.Scan(&mealID, &item.Name, &quantity, &unit); err != nil {
+				rows.Close()
+				return err
+			}
+			if quantity.Valid {
+				item.Quantity = &quantity.Float64
+			}
+			item.Unit = unit.String
+			if m := byID[mealID]; m != nil {
+				m.Items = append(m.Items, item)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// insertMeal stores a new meal for a profile with its items and returns its ID.
+func insertMeal(profileID int64, m Meal) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO meals (profile_id, timestamp, tz, note) VALUES (?, ?, ?, ?)", profileID, m.Timestamp.UTC().Format(time.RFC3339), m.TZ, m.Note)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := saveMealItems(tx, id, m.Items); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// updateMeal overwrites an existing meal of a profile and replaces its items.
+func updateMeal(profileID int64, m Meal) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE meals SET timestamp = ?, tz = ?, note = ? WHERE id = ? AND profile_id = ? AND deleted_at IS NULL",
+		m.Timestamp.UTC().Format(time.RFC3339), m.TZ, m.Note, m.ID, profileID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := saveMealItems(tx, int64(m.ID), m.Items); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// getSymptom retrieves a single symptom of a profile. Symptoms in the trash
+// are not found.
+func getSymptom(profileID int64, id interface{}) (Symptom, error) {
+	return scanSymptomRow(db.QueryRow("SELECT "+symptomColumns+" FROM symptoms WHERE id = ? AND profile_id = ? AND deleted_at IS NULL", id, profileID))
+}
+
+// insertSymptom stores a new symptom for a profile and returns its ID.
+func insertSymptom(profileID int64, s Symptom) (int64, error) {
+	res, err := db.Exec("INSERT INTO symptoms (profile_id, description, timestamp, tz, note, severity, end_timestamp, ongoing) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		profileID, s.Description, s.Timestamp.UTC().Format(time.RFC3339), s.TZ, s.Note, s.Severity, nullableTimestamp(s.EndTimestamp), s.Ongoing)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// updateSymptom overwrites an existing symptom of a profile. Symptoms in the
+// trash are not updated.
+func updateSymptom(profileID int64, id interface{}, s Symptom) error {
+	res, err := db.Exec("UPDATE symptoms SET description = ?, timestamp = ?, tz = ?, note = ?, severity = ?, end_timestamp = ?, ongoing = ? WHERE id = ? AND profile_id = ? AND deleted_at IS NULL",
+		s.Description, s.Timestamp.UTC().Format(time.RFC3339), s.TZ, s.Note, s.Severity, nullableTimestamp(s.EndTimestamp), s.Ongoing, id, profileID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// saveMealItems replaces the items of a meal.
+func saveMealItems(tx *sql.Tx, mealID int64, items []MealItem) error {
+	if _, err := tx.Exec("DELETE FROM meal_items WHERE meal_id = ?", mealID); err != nil {
+		return err
+	}
+	for i, item := range items {
+		var quantity interface{}
+		if item.Quantity != nil {
+			quantity = *item.Quantity
+		}
+		if _, err := tx.Exec("INSERT INTO meal_items (meal_id, name, position, quantity, unit) VALUES (?, ?, ?, ?, ?)",
+			mealID, item.Name, i, quantity, item.Unit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMealItemsForm reads the repeated "item", "quantity" and "unit" fields
+// of a meal form, skipping rows without a name.
+func parseMealItemsForm(r *http.Request) ([]MealItem, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	quantities, units := r.PostForm["quantity"], r.PostForm["unit"]
+	var items []MealItem
+	for i, name := range r.PostForm["item"] {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		item := MealItem{Name: name}
+		if i < len(quantities) {
+			q, err := parseQuantity(quantities[i])
+			if err != nil {
+				return nil, err
+			}
+			item.Quantity = q
+		}
+		if i < len(units) && item.Quantity != nil {
+			item.Unit = strings.TrimSpace(units[i])
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// getAllSymptoms retrieves all of a profile's symptoms from the database,
+// except those in the trash.
+func getAllSymptoms(profileID int64) ([]Symptom, error) {
+	return querySymptoms(profileID, "deleted_at IS NULL ORDER BY timestamp DESC")
+}
+
+// querySymptoms retrieves a profile's symptoms matching a WHERE clause.
+func querySymptoms(profileID int64, where string, args ...interface{}) ([]Symptom, error) {
+	rows, err := db.Query("SELECT "+symptomColumns+" FROM symptoms WHERE profile_id = ? AND "+where, append([]interface{}{profileID}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -94,5 +411,102 @@ func getAllSymptoms() ([]Symptom, error) {
 		}
 		symptoms = append(symptoms, s)
 	}
-	return symptoms, nil
+	return symptoms, rows.Err()
+}
+
+// parseSeverity parses a severity form value. An empty value gives the
+// default severity.
+func parseSeverity(v string) (int, error) {
+	if v == "" {
+		return defaultSeverity, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < minSeverity || n > maxSeverity {
+		return 0, fmt.Errorf("alvorlighetsgrad må være mellom %d og %d", minSeverity, maxSeverity)
+	}
+	return n, nil
+}
+
+// Duration returns a short human-readable duration for the symptom, or an
+// empty string if it has no recorded end.
+func (s Symptom) Duration() string {
+	if s.EndTimestamp == nil {
+		return ""
+	}
+	return formatDuration(s.EndTimestamp.Sub(s.Timestamp))
+}
+
+// formatDuration formats a duration as hours and minutes, e.g. "2 t 15 min".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	h, m := int(d.Hours()), int(d.Minutes())%60
+	if h == 0 {
+		return fmt.Sprintf("%d min", m)
+	}
+	return fmt.Sprintf("%d t %d min", h, m)
+}
+
+// parseSymptomEnd reads the optional end time and ongoing flag from a symptom
+// form.
+func parseSymptomEnd(r *http.Request, start time.Time) (*time.Time, bool, error) {
+	return parseSymptomEndValue(r.FormValue("ongoing") != "", r.FormValue("end_timestamp"), start)
+}
+
+// parseSymptomEndValue parses a symptom's end time, given as wall-clock time
+// in the zone of start or as RFC3339. An ongoing symptom has no end time;
+// otherwise the end time must not be before start.
+func parseSymptomEndValue(ongoing bool, v string, start time.Time) (*time.Time, bool, error) {
+	if ongoing {
+		return nil, true, nil
+	}
+	if v == "" {
+		return nil, false, nil
+	}
+	// The end is in the same zone as the start
+	end, err := time.ParseInLocation(timestampFormat, v, start.Location())
+	if err != nil {
+		if end, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, false, errors.New("ugyldig sluttidspunkt")
+		}
+		end = end.In(start.Location())
+	}
+	if end.Before(start) {
+		return nil, false, errors.New("sluttidspunkt er før starttidspunkt")
+	}
+	return &end, false, nil
+}
+
+// nullableTimestamp formats t for storage, or returns nil for a NULL column.
+func nullableTimestamp(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseNullableTimestamp parses an optional RFC3339 column value.
+func parseNullableTimestamp(v sql.NullString) (*time.Time, error) {
+	if !v.Valid {
+		return nil, nil
+	}
+	t, err := parseRFC3339(v.String)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// parseQuantity parses an optional, non-negative portion quantity. Both "0.5"
+// and "0,5" are accepted.
+func parseQuantity(v string) (*float64, error) {
+	v = strings.TrimSpace(strings.Replace(v, ",", ".", 1))
+	if v == "" {
+		return nil, nil
+	}
+	q, err := strconv.ParseFloat(v, 64)
+	// ParseFloat accepts "NaN" and "Inf", which cannot be encoded as JSON
+	if err != nil || q < 0 || math.IsNaN(q) || math.IsInf(q, 0) {
+		return nil, errors.New("ugyldig mengde")
+	}
+	return &q, nil
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	// Register the GIF and PNG decoders for image.Decode
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	// photoDir holds uploaded meal photos, next to data.db
+	photoDir = "photos"
+	// thumbDir holds JPEG thumbnails with the same base name as the photo
+	thumbDir = "photos/thumbs"
+
+	maxPhotoBytes  = 10 << 20 // per photo
+	maxUploadBytes = 32 << 20 // per request
+	maxPhotoPixels = 8000     // longest side, in pixels
+	thumbnailSize  = 240      // longest side, in pixels
+)
+
+// MealPhoto is an image attached to a meal.
+type MealPhoto struct {
+	ID          int    `json:"id"`
+	MealID      int    `json:"-"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+}
+
+// URL returns the path the full-size photo is served from.
+func (p MealPhoto) URL() string {
+	return "/photos/" + p.Filename
+}
+
+// ThumbURL returns the path the photo's thumbnail is served from.
+func (p MealPhoto) ThumbURL() string {
+	return "/photos/thumbs/" + thumbName(p.Filename)
+}
+
+// thumbName returns the thumbnail file name for a photo file name.
+func thumbName(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".jpg"
+}
+
+// parseUploadForm parses a multipart form if the request has one. Plain
+// url-encoded forms are left to r.FormValue.
+func parseUploadForm(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+	if err := r.ParseMultipartForm(maxUploadBytes); err != nil && err != http.ErrNotMultipart {
+		return errors.New("opplastingen er for stor eller ugyldig")
+	}
+	return nil
+}
+
+// uploadedPhotos returns the files uploaded in the "photo" field, if any.
+func uploadedPhotos(r *http.Request) []*multipart.FileHeader {
+	if r.MultipartForm == nil {
+		return nil
+	}
+	var files []*multipart.FileHeader
+	for _, fh := range r.MultipartForm.File["photo"] {
+		// Browsers send an empty part when no file was chosen
+		if fh.Size > 0 {
+			files = append(files, fh)
+		}
+	}
+	return files
+}
+
+// readPhoto reads and validates an uploaded image. It returns the raw bytes,
+// the decoded image and its format.
+func readPhoto(fh *multipart.FileHeader) ([]byte, image.Image, string, error) {
+	if fh.Size > maxPhotoBytes {
+		return nil, nil, "", errors.New("bildet er for stort (maks 10 MB)")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxPhotoBytes+1))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(data) > maxPhotoBytes {
+		return nil, nil, "", errors.New("bildet er for stort (maks 10 MB)")
+	}
+	// Check the dimensions before decoding, since a small file can declare a
+	// huge image
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, "", errors.New("ugyldig bildeformat, bruk JPEG, PNG eller GIF")
+	}
+	if cfg.Width > maxPhotoPixels || cfg.Height > maxPhotoPixels {
+		return nil, nil, "", errors.New("bildet er for stort (maks 8000 piksler på hver side)")
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, "", errors.New("ugyldig bildeformat, bruk JPEG, PNG eller GIF")
+	}
+	return data, img, format, nil
+}
+
+// photoUpload is an uploaded photo that has been read and validated.
+type photoUpload struct {
+	data   []byte
+	img    image.Image
+	format string
+}
+
+// readPhotos reads and validates all uploaded photos, so that a meal is not
+// saved when one of its photos is rejected.
+func readPhotos(files []*multipart.FileHeader) ([]photoUpload, error) {
+	var uploads []photoUpload
+	for _, fh := range files {
+		data, img, format, err := readPhoto(fh)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, photoUpload{data, img, format})
+	}
+	return uploads, nil
+}
+
+// saveMealPhotos stores validated photos and their thumbnails for a meal.
+func saveMealPhotos(mealID int64, uploads []photoUpload) error {
+	if len(uploads) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(thumbDir, 0o755); err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		name, err := randomPhotoName(u.format)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(photoDir, name), u.data, 0o644); err != nil {
+			return err
+		}
+		if err := writeThumbnail(filepath.Join(thumbDir, thumbName(name)), u.img); err != nil {
+			removePhotoFiles([]string{name})
+			return err
+		}
+		_, err = db.Exec("INSERT INTO meal_photos (meal_id, filename, content_type, created_at) VALUES (?, ?, ?, ?)",
+			mealID, name, "image/"+u.format, time.Now().UTC().Format(time.RFC3339))
+		if err != nil {
+			removePhotoFiles([]string{name})
+			return err
+		}
+	}
+	return nil
+}
+
+// randomPhotoName returns an unguessable file name with the format's extension.
+func randomPhotoName(format string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ext := "." + format
+	if format == "jpeg" {
+		ext = ".jpg"
+	}
+	return hex.EncodeToString(b) + ext, nil
+}
+
+// writeThumbnail scales img down to thumbnailSize and saves it as JPEG.
+func writeThumbnail(filename string, img image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(f, thumbnail(img, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// thumbnail scales img so its longest side is at most size pixels, averaging
+// the source pixels covered by each target pixel. Smaller images are only
+// copied, never enlarged.
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > size || h > size {
+		if w >= h {
+			tw, th = size, h*size/w
+		} else {
+			tw, th = w*size/h, size
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+	out := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+					n++
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return out
+}
+
+// loadMealPhotos fills in Photos for each of a profile's meals.
+func loadMealPhotos(profileID int64, meals []Meal) error {
+	if len(meals) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Meal, len(meals))
+	for i := range meals {
+		byID[meals[i].ID] = &meals[i]
+	}
+	// Photos are few compared to meals, so fetching all of the profile's is
+	// cheaper than an IN list
+	rows, err := db.Query(`SELECT p.id, p.meal_id, p.filename, p.content_type FROM meal_photos p
+		JOIN meals m ON m.id = p.meal_id WHERE m.profile_id = ? ORDER BY p.meal_id, p.id`, profileID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p MealPhoto
+		if err := rows.Scan(&p.ID, &p.MealID, &p.Filename, &p.ContentType); err != nil {
+			return err
+		}
+		if m := byID[p.MealID]; m != nil {
+			m.Photos = append(m.Photos, p)
+		}
+	}
+	return rows.Err()
+}
+
+// mealPhotoFilenames returns the photo file names of a meal.
+func mealPhotoFilenames(mealID interface{}) ([]string, error) {
+	rows, err := db.Query("SELECT filename FROM meal_photos WHERE meal_id = ?", mealID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// removePhotoFiles deletes photo files and their thumbnails. Failures are
+// logged, since the database rows are already gone.
+func removePhotoFiles(filenames []string) {
+	for _, name := range filenames {
+		for _, p := range []string{filepath.Join(photoDir, name), filepath.Join(thumbDir, thumbName(name))} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				log.Printf("could not remove photo file: %v", err)
+			}
+		}
+	}
+}
+
+// photoHandler serves the profile's photos and thumbnails without directory
+// listings.
+func photoHandler(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(r.URL.Path, "/photos/")
+	dir, name := photoDir, rel
+	if strings.HasPrefix(rel, "thumbs/") {
+		dir, name = thumbDir, strings.TrimPrefix(rel, "thumbs/")
+	}
+	if name == "" || name != path.Base(name) || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	// Only photos of the profile's own meals are served. Thumbnails share the
+	// base name of their photo, but are always JPEG.
+	prefix := strings.TrimSuffix(name, filepath.Ext(name)) + "."
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM meal_photos p JOIN meals m ON m.id = p.meal_id
+		WHERE m.profile_id = ? AND substr(p.filename, 1, ?) = ?`, currentProfileID(r), len(prefix), prefix).Scan(&n)
+	if err != nil || n == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(dir, name))
+}
+
+// deletePhotoHandler removes a single photo from a meal and returns to the
+// meal's edit page.
+func deletePhotoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	pid := currentProfileID(r)
+	var mealID int
+	var filename string
+	err := db.QueryRow(`SELECT p.meal_id, p.filename FROM meal_photos p JOIN meals m ON m.id = p.meal_id
+		WHERE p.id = ? AND m.profile_id = ? AND m.deleted_at IS NULL`, r.FormValue("id"), pid).Scan(&mealID, &filename)
+	if err != nil {
+		http.Error(w, "bilde ikke funnet", http.StatusNotFound)
+		return
+	}
+	before := entryBefore(pid, entityMeal, mealID)
+	if _, err := db.Exec("DELETE FROM meal_photos WHERE id = ?", r.FormValue("id")); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	removePhotoFiles([]string{filename})
+	recordRevision(pid, entityMeal, int64(mealID), revUpdate, channelWeb, before)
+	http.Redirect(w, r, "/meals/edit?id="+strconv.Itoa(mealID), http.StatusSeeOther)
+}
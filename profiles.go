@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxProfileNameLength is the longest profile name, in characters.
+const maxProfileNameLength = 50
+
+// Profile is a separate diary within a user account, such as one for each
+// member of a household. Entries, check-ins, meal templates, suggestion
+// settings, event kinds and the food catalog belong to a profile.
+type Profile struct {
+	ID     int64  `json:"id"`
+	UserID int64  `json:"-"`
+	Name   string `json:"name"`
+}
+
+// insertProfile creates a profile for a user and returns its ID.
+func insertProfile(tx *sql.Tx, userID int64, name string) (int64, error) {
+	res, err := tx.Exec("INSERT INTO profiles (user_id, name, created_at) VALUES (?, ?, ?)",
+		userID, name, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// insertProfileDefaults gives a profile the default event kinds and foods
+// that it does not already have.
+func insertProfileDefaults(tx *sql.Tx, profileID int64) error {
+	if err := insertDefaultEventKinds(tx, profileID); err != nil {
+		return err
+	}
+	return insertDefaultFoods(tx, profileID)
+}
+
+// getProfiles returns a user's profiles in the order they were created.
+func getProfiles(userID int64) ([]Profile, error) {
+	rows, err := db.Query("SELECT id, user_id, name FROM profiles WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var profiles []Profile
+	for rows.Next() {
+		var p Profile
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Name); err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, rows.Err()
+}
+
+// findProfile returns the first of a user's profiles matching a WHERE
+// clause, or nil if there is none.
+func findProfile(userID int64, where string, args ...interface{}) (*Profile, error) {
+	var p Profile
+	err := db.QueryRow("SELECT id, user_id, name FROM profiles WHERE user_id = ? AND "+where+" ORDER BY id LIMIT 1",
+		append([]interface{}{userID}, args...)...).Scan(&p.ID, &p.UserID, &p.Name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// findProfileByName returns a user's profile with the given name, ignoring
+// case, or nil if there is none.
+func findProfileByName(userID int64, name string) (*Profile, error) {
+	return findProfile(userID, "name = ?", strings.TrimSpace(name))
+}
+
+// selectedProfile returns the profile selected in a session if it belongs to
+// the user, and otherwise the user's first profile.
+func selectedProfile(userID, profileID int64) (*Profile, error) {
+	if profileID != 0 {
+		p, err := findProfile(userID, "id = ?", profileID)
+		if p != nil || err != nil {
+			return p, err
+		}
+	}
+	return findProfile(userID, "1 = 1")
+}
+
+// validProfileName trims a profile name and checks its length.
+func validProfileName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	return name, name != "" && len([]rune(name)) <= maxProfileNameLength
+}
+
+// deleteProfile deletes one of a user's profiles with all its entries and
+// their history and photos. It returns false if the profile was not found.
+func deleteProfile(userID, profileID int64) (bool, error) {
+	var photos []string
+	rows, err := db.Query(`SELECT p.filename FROM meal_photos p JOIN meals m ON m.id = p.meal_id
+		JOIN profiles pr ON pr.id = m.profile_id WHERE pr.id = ? AND pr.user_id = ?`, profileID, userID)
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return false, err
+		}
+		photos = append(photos, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	owned := "profile_id = (SELECT id FROM profiles WHERE id = ? AND user_id = ?)"
+	for entity, table := range trashTables {
+		if err := deleteRevisions(entity, table, owned, profileID, userID); err != nil {
+			return false, err
+		}
+	}
+	res, err := db.Exec("DELETE FROM profiles WHERE id = ? AND user_id = ?", profileID, userID)
+	if err != nil {
+		return false, err
+	}
+	removePhotoFiles(photos)
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// setSessionProfile selects a profile in the request's login session.
+func setSessionProfile(r *http.Request, profileID int64) error {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE sessions SET profile_id = ? WHERE token_hash = ?", profileID, hashToken(c.Value))
+	return err
+}
+
+// profilesHandler lists the user's profiles and creates new ones.
+func profilesHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if r.Method == http.MethodPost {
+		name, ok := validProfileName(r.FormValue("name"))
+		if !ok {
+			http.Error(w, "navnet må være mellom 1 og 50 tegn", http.StatusBadRequest)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		id, err := insertProfile(tx, u.ID, name)
+		if isUniqueViolation(err) {
+			http.Error(w, "du har allerede en profil med dette navnet", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		if err := insertProfileDefaults(tx, id); err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profiles", http.StatusSeeOther)
+		return
+	}
+	profiles, err := getProfiles(u.ID)
+	if err != nil {
+		http.Error(w, "kunne ikke hente profiler", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Profiles []Profile
+		Profile  *Profile
+	}{profiles, currentProfile(r)}
+	if err := templates.ExecuteTemplate(w, "profiles.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// switchProfileHandler selects the profile to log and view entries for in
+// the current session.
+func switchProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	p, err := findProfile(currentUser(r).ID, "id = ?", r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "kunne ikke hente profil", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "profil ikke funnet", http.StatusNotFound)
+		return
+	}
+	if err := setSessionProfile(r, p.ID); err != nil {
+		http.Error(w, "kunne ikke bytte profil", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, safeNext(r.FormValue("next")), http.StatusSeeOther)
+}
+
+// renameProfileHandler renames one of the user's profiles.
+func renameProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/profiles", http.StatusSeeOther)
+		return
+	}
+	name, ok := validProfileName(r.FormValue("name"))
+	if !ok {
+		http.Error(w, "navnet må være mellom 1 og 50 tegn", http.StatusBadRequest)
+		return
+	}
+	res, err := db.Exec("UPDATE profiles SET name = ? WHERE id = ? AND user_id = ?", name, r.FormValue("id"), currentUser(r).ID)
+	if isUniqueViolation(err) {
+		http.Error(w, "du har allerede en profil med dette navnet", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "profil ikke funnet", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, "/profiles", http.StatusSeeOther)
+}
+
+// deleteProfileHandler deletes one of the user's profiles and everything
+// logged in it. The last profile cannot be deleted.
+func deleteProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/profiles", http.StatusSeeOther)
+		return
+	}
+	u := currentUser(r)
+	p, err := findProfile(u.ID, "id = ?", r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "kunne ikke hente profil", http.StatusInternalServerError)
+		return
+	}
+	if p == nil {
+		http.Error(w, "profil ikke funnet", http.StatusNotFound)
+		return
+	}
+	profiles, err := getProfiles(u.ID)
+	if err != nil {
+		http.Error(w, "kunne ikke hente profiler", http.StatusInternalServerError)
+		return
+	}
+	if len(profiles) <= 1 {
+		http.Error(w, "den siste profilen kan ikke slettes", http.StatusBadRequest)
+		return
+	}
+	if _, err := deleteProfile(u.ID, p.ID); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/profiles", http.StatusSeeOther)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ReportData holds daily counts of meals and symptoms for the report page.
+type ReportData struct {
+	Days         []string         `json:"days"`
+	Meals        []int            `json:"meals"`
+	Symptoms     []int            `json:"symptoms"`
+	MealItems    map[string][]int `json:"meal_items"`
+	SymptomTypes map[string][]int `json:"symptom_types"`
+	// Stools counts bowel movements per day, and BristolMean is the mean
+	// Bristol type per day, or null on days without any
+	Stools      []int      `json:"stools"`
+	BristolMean []*float64 `json:"bristol_mean"`
+	// CheckIns holds each check-in score per day, keyed by metric, with null
+	// on days without a check-in
+	CheckIns map[string][]*int `json:"checkins"`
+}
+
+// LatencyHistogram holds the distribution of time from meal to next symptom.
+type LatencyHistogram struct {
+	BinSize   float64 `json:"bin_size"`
+	Bins      []int   `json:"bins"`
+	Counts    []int   `json:"counts"`
+	Unmatched int     `json:"unmatched"`
+}
+
+// MealSymptomPair links a meal to the first symptom logged after it.
+type MealSymptomPair struct {
+	MealID          int      `json:"meal_id"`
+	MealItems       string   `json:"meal_items"`
+	MealTimestamp   string   `json:"meal_timestamp"`
+	NextSymptomID   *int     `json:"next_symptom_id"`
+	NextSymptomDesc string   `json:"next_symptom_desc,omitempty"`
+	TimeDiffHours   *float64 `json:"time_diff_hours"`
+}
+
+// reportPageHandler displays the report page.
+func reportPageHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	data := struct {
+		Start, End     string
+		CheckInMetrics []CheckInMetric
+		CheckInMaxLag  int
+	}{
+		Start:          now.AddDate(0, 0, -defaultReportDays).Format(dateFormat),
+		End:            now.Format(dateFormat),
+		CheckInMetrics: checkInMetrics,
+		CheckInMaxLag:  defaultCheckInMaxLag,
+	}
+	if err := templates.ExecuteTemplate(w, "report.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// reportDataHandler returns meal and symptom counts per calendar day, local to
+// the zone each entry was logged in, with breakdowns per meal item and per
+// symptom type. The item breakdown can be grouped with the "group" and "level"
+// parameters, see newFoodGrouper.
+func reportDataHandler(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseLocalDateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	groupsOf, err := newFoodGrouper(currentProfileID(r), r.URL.Query().Get("group"), parseGroupLevel(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pid := currentProfileID(r)
+	meals, err := getAllMeals(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente måltider", http.StatusInternalServerError)
+		return
+	}
+	symptoms, err := getAllSymptoms(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
+		return
+	}
+
+	data := ReportData{
+		MealItems:    make(map[string][]int),
+		SymptomTypes: make(map[string][]int),
+	}
+	dayIndex := make(map[string]int)
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		day := d.Format(dateFormat)
+		dayIndex[day] = len(data.Days)
+		data.Days = append(data.Days, day)
+	}
+	data.Meals = make([]int, len(data.Days))
+	data.Symptoms = make([]int, len(data.Days))
+	data.Stools = make([]int, len(data.Days))
+	data.BristolMean = make([]*float64, len(data.Days))
+
+	for _, m := range meals {
+		i, ok := dayIndex[entryDate(m.Timestamp, m.TZ)]
+		if !ok {
+			continue
+		}
+		data.Meals[i]++
+		// Count each group once per meal, even if several items map to it
+		seen := make(map[string]bool)
+		for _, item := range m.ItemNames() {
+			for _, group := range groupsOf(item) {
+				if seen[group] {
+					continue
+				}
+				seen[group] = true
+				if data.MealItems[group] == nil {
+					data.MealItems[group] = make([]int, len(data.Days))
+				}
+				data.MealItems[group][i]++
+			}
+		}
+	}
+	for _, s := range symptoms {
+		i, ok := dayIndex[entryDate(s.Timestamp, s.TZ)]
+		if !ok {
+			continue
+		}
+		data.Symptoms[i]++
+		if data.SymptomTypes[s.Description] == nil {
+			data.SymptomTypes[s.Description] = make([]int, len(data.Days))
+		}
+		data.SymptomTypes[s.Description][i]++
+	}
+	stools, err := getAllStools(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente avføringslogg", http.StatusInternalServerError)
+		return
+	}
+	bristolSums := make([]int, len(data.Days))
+	for _, s := range stools {
+		i, ok := dayIndex[entryDate(s.Timestamp, s.TZ)]
+		if !ok {
+			continue
+		}
+		data.Stools[i]++
+		bristolSums[i] += s.Bristol
+	}
+	for i, n := range data.Stools {
+		if n > 0 {
+			mean := float64(bristolSums[i]) / float64(n)
+			data.BristolMean[i] = &mean
+		}
+	}
+	checkIns, err := getCheckIns(pid, start.Format(dateFormat), end.AddDate(0, 0, -1).Format(dateFormat))
+	if err != nil {
+		http.Error(w, "kunne ikke hente innsjekkinger", http.StatusInternalServerError)
+		return
+	}
+	data.CheckIns = make(map[string][]*int)
+	for _, m := range checkInMetrics {
+		scores := make([]*int, len(data.Days))
+		for i, day := range data.Days {
+			if c, ok := checkIns[day]; ok {
+				score := c.Score(m.Key)
+				scores[i] = &score
+			}
+		}
+		data.CheckIns[m.Key] = scores
+	}
+
+	if err := writeJSONResponse(w, data); err != nil {
+		http.Error(w, "feil ved encoding av JSON", http.StatusInternalServerError)
+	}
+}
+
+// crossCorrPageHandler displays the meal-to-symptom latency page.
+func crossCorrPageHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	data := struct {
+		Start, End    string
+		BinSize       float64
+		LookAheadDays int
+	}{
+		Start:         now.AddDate(0, 0, -defaultTimeSeriesDays).Format(dateFormat),
+		End:           now.Format(dateFormat),
+		BinSize:       defaultBinSizeMinutes,
+		LookAheadDays: defaultLookAheadDays,
+	}
+	if err := templates.ExecuteTemplate(w, "crosscorr.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// crossCorrDataHandler returns a histogram of minutes from each meal to the
+// next symptom. Optional query parameters: bin (minutes, at least 1),
+// lookahead (days, at most 30), item (meal item filter) and symptom (symptom
+// type filter).
+func crossCorrDataHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end := q.Get("start"), q.Get("end")
+	if _, err := parseDateOnly(start); err != nil {
+		http.Error(w, "ugyldig startdato", http.StatusBadRequest)
+		return
+	}
+	endDate, err := parseDateOnly(end)
+	if err != nil {
+		http.Error(w, "ugyldig sluttdato", http.StatusBadRequest)
+		return
+	}
+	binSize := defaultBinSizeMinutes
+	if v := q.Get("bin"); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed > 0 {
+			binSize = parsed
+		}
+	}
+	// Tiny bins or long look-aheads would make the histogram huge
+	if binSize < minBinSizeMinutes {
+		binSize = minBinSizeMinutes
+	}
+	lookAheadDays := defaultLookAheadDays
+	if v := q.Get("lookahead"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			lookAheadDays = parsed
+		}
+	}
+	if lookAheadDays > maxLookAheadDays {
+		lookAheadDays = maxLookAheadDays
+	}
+
+	pid := currentProfileID(r)
+	meals, err := queryMealTimestamps(pid, start, end, q.Get("item"))
+	if err != nil {
+		http.Error(w, "kunne ikke hente måltider", http.StatusInternalServerError)
+		return
+	}
+	// Symptoms are fetched past the end date so late meals can be matched
+	symptomEnd := endDate.AddDate(0, 0, lookAheadDays).Format(dateFormat)
+	symptoms, err := querySymptomTimestamps(pid, start, symptomEnd, q.Get("symptom"))
+	if err != nil {
+		http.Error(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
+		return
+	}
+
+	lookAhead := time.Duration(lookAheadDays) * 24 * time.Hour
+	bins, counts, unmatched := latencyHistogram(meals, symptoms, binSize, lookAhead)
+	data := LatencyHistogram{
+		BinSize:   binSize,
+		Bins:      bins,
+		Counts:    counts,
+		Unmatched: unmatched,
+	}
+	if err := writeJSONResponse(w, data); err != nil {
+		http.Error(w, "feil ved encoding av JSON", http.StatusInternalServerError)
+	}
+}
+
+// mealSymptomAnalysisPageHandler displays the meal-by-meal analysis page.
+func mealSymptomAnalysisPageHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	data := struct {
+		StartDate, EndDate string
+		HorizonHours       int
+	}{
+		StartDate:    now.AddDate(0, 0, -defaultReportDays).Format(dateFormat),
+		EndDate:      now.Format(dateFormat),
+		HorizonHours: defaultHorizonHours,
+	}
+	if err := templates.ExecuteTemplate(w, "meal_symptom_analysis.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// mealSymptomDataHandler returns each meal in the date range paired with the
+// next symptom logged within the horizon (query parameter, in hours).
+func mealSymptomDataHandler(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseLocalDateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	horizonHours := defaultHorizonHours
+	if v := r.URL.Query().Get("horizon"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			horizonHours = parsed
+		}
+	}
+	horizon := time.Duration(horizonHours) * time.Hour
+
+	pid := currentProfileID(r)
+	meals, err := getAllMeals(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente måltider", http.StatusInternalServerError)
+		return
+	}
+	symptoms, err := getAllSymptoms(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
+		return
+	}
+	// Both lists come newest first; pair them in chronological order
+	sort.Slice(meals, func(i, j int) bool { return meals[i].Timestamp.Before(meals[j].Timestamp) })
+	sort.Slice(symptoms, func(i, j int) bool { return symptoms[i].Timestamp.Before(symptoms[j].Timestamp) })
+
+	// Meals are picked by their date in the zone they were logged in
+	first, last := start.Format(dateFormat), end.AddDate(0, 0, -1).Format(dateFormat)
+	pairs := []MealSymptomPair{}
+	for _, m := range meals {
+		if date := entryDate(m.Timestamp, m.TZ); date < first || date > last {
+			continue
+		}
+		p := MealSymptomPair{
+			MealID:        m.ID,
+			MealItems:     m.ItemsText(),
+			MealTimestamp: m.DisplayTime,
+		}
+		i := sort.Search(len(symptoms), func(i int) bool { return !symptoms[i].Timestamp.Before(m.Timestamp) })
+		if i < len(symptoms) && symptoms[i].Timestamp.Sub(m.Timestamp) <= horizon {
+			s := symptoms[i]
+			diff := s.Timestamp.Sub(m.Timestamp).Hours()
+			p.NextSymptomID = &s.ID
+			p.NextSymptomDesc = s.Description
+			p.TimeDiffHours = &diff
+		}
+		pairs = append(pairs, p)
+	}
+
+	if err := writeJSONResponse(w, pairs); err != nil {
+		http.Error(w, "feil ved encoding av JSON", http.StatusInternalServerError)
+	}
+}
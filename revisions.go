@@ -0,0 +1,404 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// Entities with a revision history
+	entityMeal    = "meal"
+	entitySymptom = "symptom"
+
+	// Revision actions
+	revCreate  = "create"
+	revUpdate  = "update"
+	revDelete  = "delete"
+	revRestore = "restore"
+	revRevert  = "revert"
+
+	// Channels a change can come through
+	channelWeb = "web"
+	channelAPI = "api"
+)
+
+// revisionActionLabels describes each revision action for the history page.
+var revisionActionLabels = map[string]string{
+	revCreate:  "Opprettet",
+	revUpdate:  "Endret",
+	revDelete:  "Slettet",
+	revRestore: "Gjenopprettet",
+	revRevert:  "Tilbakestilt",
+}
+
+// Revision is a recorded change to a meal or symptom.
+type Revision struct {
+	ID        int
+	Entity    string
+	EntityID  int
+	Action    string
+	Channel   string
+	OldData   string
+	NewData   string
+	CreatedAt time.Time
+	// Changes lists the fields that differ between the old and new data
+	Changes []RevisionChange
+	// Latest is true for the most recent revision of the entry
+	Latest bool
+}
+
+// ActionText returns the action in Norwegian.
+func (r Revision) ActionText() string {
+	return revisionActionLabels[r.Action]
+}
+
+// ChannelText returns where the change was made.
+func (r Revision) ChannelText() string {
+	if r.Channel == channelAPI {
+		return "API"
+	}
+	return "Nettskjema"
+}
+
+// CanRevert reports whether the entry can be reverted to the state after
+// this revision.
+func (r Revision) CanRevert() bool {
+	return !r.Latest && r.Action != revDelete
+}
+
+// RevisionChange is a field that changed in a revision.
+type RevisionChange struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// revisionField is a labeled field value of a snapshot, for comparison.
+type revisionField struct {
+	Label string
+	Value string
+}
+
+// deletedText shows whether a snapshot was in the trash.
+func deletedText(deletedAt *time.Time) string {
+	if deletedAt == nil {
+		return "Nei"
+	}
+	return "Ja"
+}
+
+// formatRevisionTime formats a timestamp for the history page, in the zone
+// the entry was logged in.
+func formatRevisionTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(displayFormat)
+}
+
+// mealFields returns the fields of a meal snapshot shown in the history.
+func mealFields(m Meal) []revisionField {
+	photos := make([]string, len(m.Photos))
+	for i, p := range m.Photos {
+		photos[i] = p.Filename
+	}
+	return []revisionField{
+		{"Tidspunkt", formatRevisionTime(&m.Timestamp)},
+		{"Tidssone", m.TZ},
+		{"Matvarer", m.ItemsText()},
+		{"Notat", m.Note},
+		{"Bilder", strconv.Itoa(len(photos))},
+		{"Slettet", deletedText(m.DeletedAt)},
+	}
+}
+
+// symptomFields returns the fields of a symptom snapshot shown in the history.
+func symptomFields(s Symptom) []revisionField {
+	ongoing := "Nei"
+	if s.Ongoing {
+		ongoing = "Ja"
+	}
+	return []revisionField{
+		{"Symptom", s.Description},
+		{"Tidspunkt", formatRevisionTime(&s.Timestamp)},
+		{"Tidssone", s.TZ},
+		{"Slutt", formatRevisionTime(s.EndTimestamp)},
+		{"Pågår", ongoing},
+		{"Alvorlighet", strconv.Itoa(s.Severity)},
+		{"Notat", s.Note},
+		{"Slettet", deletedText(s.DeletedAt)},
+	}
+}
+
+// snapshotFields decodes a JSON snapshot of an entity into labeled fields.
+// An empty snapshot gives no fields.
+func snapshotFields(entity, data string) ([]revisionField, error) {
+	if data == "" {
+		return nil, nil
+	}
+	if entity == entityMeal {
+		var m Meal
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			return nil, err
+		}
+		return mealFields(m), nil
+	}
+	var s Symptom
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return nil, err
+	}
+	return symptomFields(s), nil
+}
+
+// revisionChanges compares the old and new snapshot of a revision.
+func revisionChanges(rev Revision) ([]RevisionChange, error) {
+	oldFields, err := snapshotFields(rev.Entity, rev.OldData)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := snapshotFields(rev.Entity, rev.NewData)
+	if err != nil {
+		return nil, err
+	}
+	var changes []RevisionChange
+	for i, f := range newFields {
+		old := ""
+		if oldFields != nil {
+			old = oldFields[i].Value
+		}
+		if old != f.Value {
+			changes = append(changes, RevisionChange{Field: f.Label, Old: old, New: f.Value})
+		}
+	}
+	return changes, nil
+}
+
+// findMeal returns a profile's meal, including meals in the trash, or nil if
+// there is none.
+func findMeal(profileID int64, id interface{}) (*Meal, error) {
+	meals, err := queryMeals(profileID, "id = ?", id)
+	if err != nil || len(meals) == 0 {
+		return nil, err
+	}
+	return &meals[0], nil
+}
+
+// findSymptom returns a profile's symptom, including symptoms in the trash, or
+// nil if there is none.
+func findSymptom(profileID int64, id interface{}) (*Symptom, error) {
+	symptoms, err := querySymptoms(profileID, "id = ?", id)
+	if err != nil || len(symptoms) == 0 {
+		return nil, err
+	}
+	return &symptoms[0], nil
+}
+
+// findEntry returns the current state of a profile's meal or symptom, or nil if
+// there is none.
+func findEntry(profileID int64, entity string, id interface{}) (interface{}, error) {
+	if entity == entityMeal {
+		m, err := findMeal(profileID, id)
+		if m == nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	s, err := findSymptom(profileID, id)
+	if s == nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// recordRevision stores a revision with the entry's state before the change
+// and its current state after it. before is nil for created entries. Since
+// the change itself has already been saved, failures are only logged.
+func recordRevision(profileID int64, entity string, id int64, action, channel string, before interface{}) {
+	after, err := findEntry(profileID, entity, id)
+	if err != nil || after == nil {
+		log.Printf("could not record revision of %s %d: %v", entity, id, err)
+		return
+	}
+	var oldData interface{}
+	if before != nil {
+		b, err := json.Marshal(before)
+		if err != nil {
+			log.Printf("could not record revision of %s %d: %v", entity, id, err)
+			return
+		}
+		oldData = string(b)
+	}
+	newData, err := json.Marshal(after)
+	if err != nil {
+		log.Printf("could not record revision of %s %d: %v", entity, id, err)
+		return
+	}
+	_, err = db.Exec("INSERT INTO revisions (entity, entity_id, action, channel, old_data, new_data, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entity, id, action, channel, oldData, string(newData), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		log.Printf("could not record revision of %s %d: %v", entity, id, err)
+	}
+}
+
+// entryBefore returns the current state of an entry for recordRevision, or
+// nil if it cannot be read. Errors are logged, since they should not stop
+// the change itself.
+func entryBefore(profileID int64, entity string, id interface{}) interface{} {
+	before, err := findEntry(profileID, entity, id)
+	if err != nil {
+		log.Printf("could not read %s %v before change: %v", entity, id, err)
+	}
+	return before
+}
+
+// revisionColumns lists the columns read by scanRevisionRow, in order.
+const revisionColumns = "id, entity, entity_id, action, channel, old_data, new_data, created_at"
+
+// scanRevisionRow scans a database row into a Revision struct.
+func scanRevisionRow(rows rowScanner) (Revision, error) {
+	var rev Revision
+	var oldData sql.NullString
+	var createdAt string
+	if err := rows.Scan(&rev.ID, &rev.Entity, &rev.EntityID, &rev.Action, &rev.Channel, &oldData, &rev.NewData, &createdAt); err != nil {
+		return rev, err
+	}
+	rev.OldData = oldData.String
+	t, err := parseRFC3339(createdAt)
+	if err != nil {
+		return rev, err
+	}
+	rev.CreatedAt = t
+	return rev, nil
+}
+
+// getRevisions returns the revisions of an entry, newest first.
+func getRevisions(entity string, id interface{}) ([]Revision, error) {
+	rows, err := db.Query("SELECT "+revisionColumns+" FROM revisions WHERE entity = ? AND entity_id = ? ORDER BY id DESC", entity, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revisions []Revision
+	for rows.Next() {
+		rev, err := scanRevisionRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		if rev.Changes, err = revisionChanges(rev); err != nil {
+			return nil, err
+		}
+		rev.Latest = len(revisions) == 0
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// validEntity reports whether entity has a revision history.
+func validEntity(entity string) bool {
+	return entity == entityMeal || entity == entitySymptom
+}
+
+// historyHandler shows the revision history of one of the profile's meals or
+// symptoms. Query parameters: entity (meal or symptom) and id.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	entity := r.URL.Query().Get("entity")
+	id := r.URL.Query().Get("id")
+	if !validEntity(entity) {
+		http.Error(w, "ugyldig type", http.StatusBadRequest)
+		return
+	}
+	// History is removed together with the entry, so an entry that is not
+	// found has no history the user may see
+	current, err := findEntry(currentProfileID(r), entity, id)
+	if err != nil {
+		http.Error(w, "kunne ikke hente historikk", http.StatusInternalServerError)
+		return
+	}
+	if current == nil {
+		http.Error(w, "oppføring ikke funnet", http.StatusNotFound)
+		return
+	}
+	revisions, err := getRevisions(entity, id)
+	if err != nil {
+		http.Error(w, "kunne ikke hente historikk", http.StatusInternalServerError)
+		return
+	}
+	title := "måltid"
+	if entity == entitySymptom {
+		title = "symptom"
+	}
+	data := struct {
+		Entity    string
+		EntityID  string
+		Title     string
+		EditURL   string
+		Revisions []Revision
+	}{entity, id, title, "/" + entity + "s/edit?id=" + id, revisions}
+	if err := templates.ExecuteTemplate(w, "history.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// revertHandler restores an entry to its state after a given revision. The
+// revert is itself recorded as a revision. Photos are not restored.
+func revertHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	rev, err := scanRevisionRow(db.QueryRow("SELECT "+revisionColumns+" FROM revisions WHERE id = ?", r.FormValue("id")))
+	if err == sql.ErrNoRows {
+		http.Error(w, "revisjon ikke funnet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "kunne ikke hente revisjon", http.StatusInternalServerError)
+		return
+	}
+	// Revisions of other users' entries are not found
+	pid := currentProfileID(r)
+	before := entryBefore(pid, rev.Entity, rev.EntityID)
+	if before == nil {
+		http.Error(w, "revisjon ikke funnet", http.StatusNotFound)
+		return
+	}
+	if rev.Action == revDelete {
+		http.Error(w, "en sletting kan ikke tilbakestilles, bruk papirkurven", http.StatusBadRequest)
+		return
+	}
+	switch rev.Entity {
+	case entityMeal:
+		var m Meal
+		if err = json.Unmarshal([]byte(rev.NewData), &m); err == nil {
+			m.ID = rev.EntityID
+			err = updateMeal(pid, m)
+		}
+	case entitySymptom:
+		var s Symptom
+		if err = json.Unmarshal([]byte(rev.NewData), &s); err == nil {
+			err = updateSymptom(pid, rev.EntityID, s)
+		}
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "oppføringen finnes ikke eller ligger i papirkurven", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "feil ved tilbakestilling", http.StatusInternalServerError)
+		return
+	}
+	recordRevision(pid, rev.Entity, int64(rev.EntityID), revRevert, channelWeb, before)
+	http.Redirect(w, r, "/history?entity="+rev.Entity+"&id="+strconv.Itoa(rev.EntityID), http.StatusSeeOther)
+}
+
+// deleteRevisions removes the history of purged entries. The where clause
+// selects the purged rows of the entity's table.
+func deleteRevisions(entity, table, where string, args ...interface{}) error {
+	_, err := db.Exec("DELETE FROM revisions WHERE entity = ? AND entity_id IN (SELECT id FROM "+table+" WHERE "+where+")",
+		append([]interface{}{entity}, args...)...)
+	return err
+}
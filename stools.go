@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Bristol Stool Scale types run from 1 (hard lumps) to 7 (entirely liquid).
+// Types 3 and 4 are considered normal.
+const (
+	minBristol     = 1
+	maxBristol     = 7
+	defaultBristol = 4
+)
+
+// bristolTypes describes each Bristol type, indexed by type - 1.
+var bristolTypes = []string{
+	"Separate harde klumper",
+	"Pølseformet, men klumpete",
+	"Pølseformet med sprekker",
+	"Pølseformet, glatt og myk",
+	"Myke klumper med klare kanter",
+	"Grøtaktig med ujevne kanter",
+	"Vandig, uten faste biter",
+}
+
+// urgencyLevels describes each urgency level, indexed by level.
+var urgencyLevels = []string{"Ingen", "Litt", "Tydelig", "Akutt"}
+
+// Outcome series built from stools for the time series analysis
+const (
+	looseStoolSeries = "💩 Løs avføring (Bristol 5–7)"
+	hardStoolSeries  = "💩 Hard avføring (Bristol 1–2)"
+)
+
+// BristolOption is a Bristol type with its description, for form selects.
+type BristolOption struct {
+	Type        int
+	Description string
+}
+
+// bristolOptions returns all Bristol types with descriptions.
+func bristolOptions() []BristolOption {
+	options := make([]BristolOption, len(bristolTypes))
+	for i, d := range bristolTypes {
+		options[i] = BristolOption{Type: i + 1, Description: d}
+	}
+	return options
+}
+
+// Stool represents a logged bowel movement.
+type Stool struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	// TZ is the IANA zone or UTC offset the stool was logged in. Empty means
+	// the server's zone.
+	TZ          string `json:"tz,omitempty"`
+	Bristol     int    `json:"bristol"`
+	Urgency     int    `json:"urgency"`
+	Note        string `json:"note"`
+	DisplayTime string `json:"-"`
+	InputTime   string `json:"-"`
+}
+
+// BristolText returns the description of the stool's Bristol type.
+func (s Stool) BristolText() string {
+	if s.Bristol < minBristol || s.Bristol > maxBristol {
+		return ""
+	}
+	return bristolTypes[s.Bristol-1]
+}
+
+// UrgencyText returns the description of the stool's urgency level.
+func (s Stool) UrgencyText() string {
+	if s.Urgency < 0 || s.Urgency >= len(urgencyLevels) {
+		return ""
+	}
+	return urgencyLevels[s.Urgency]
+}
+
+// stoolColumns lists the columns read by scanStoolRow, in order.
+const stoolColumns = "id, timestamp, tz, bristol, urgency, note"
+
+// scanStoolRow scans a database row into a Stool struct.
+func scanStoolRow(rows rowScanner) (Stool, error) {
+	var s Stool
+	var ts string
+	var note sql.NullString
+	if err := rows.Scan(&s.ID, &ts, &s.TZ, &s.Bristol, &s.Urgency, &note); err != nil {
+		return s, err
+	}
+	t, err := parseRFC3339(ts)
+	if err != nil {
+		return s, err
+	}
+	// Times are shown as the wall-clock time where the stool was logged
+	s.Timestamp = t.In(entryLocation(s.TZ))
+	s.DisplayTime = s.Timestamp.Format(displayFormat)
+	s.InputTime = s.Timestamp.Format(timestampFormat)
+	s.Note = note.String
+	return s, nil
+}
+
+// getAllStools retrieves all of a profile's stools from the database, newest
+// first.
+func getAllStools(profileID int64) ([]Stool, error) {
+	rows, err := db.Query("SELECT "+stoolColumns+" FROM stools WHERE profile_id = ? ORDER BY timestamp DESC", profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stools []Stool
+	for rows.Next() {
+		s, err := scanStoolRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		stools = append(stools, s)
+	}
+	return stools, rows.Err()
+}
+
+// parseStoolForm reads a stool entry from the index or edit form.
+func parseStoolForm(r *http.Request) (Stool, error) {
+	var s Stool
+	var err error
+	s.Bristol, err = strconv.Atoi(r.FormValue("bristol"))
+	if err != nil || s.Bristol < minBristol || s.Bristol > maxBristol {
+		return s, errors.New("Bristol-type må være mellom 1 og 7")
+	}
+	if v := r.FormValue("urgency"); v != "" {
+		s.Urgency, err = strconv.Atoi(v)
+		if err != nil || s.Urgency < 0 || s.Urgency >= len(urgencyLevels) {
+			return s, errors.New("ugyldig hastegrad")
+		}
+	}
+	// The forms send the wall-clock time and the zone: the browser's for new
+	// stools and the logged zone when editing
+	if s.Timestamp, s.TZ, err = parseEntryTime(r.FormValue("timestamp"), r.FormValue("tz")); err != nil {
+		return s, err
+	}
+	s.Note = r.FormValue("note")
+	return s, nil
+}
+
+// stoolsHandler logs a new stool from the index page.
+func stoolsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	s, err := parseStoolForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("INSERT INTO stools (profile_id, timestamp, tz, bristol, urgency, note) VALUES (?, ?, ?, ?, ?, ?)",
+		currentProfileID(r), s.Timestamp.UTC().Format(time.RFC3339), s.TZ, s.Bristol, s.Urgency, s.Note)
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// editStoolHandler displays a form to edit an existing stool entry.
+func editStoolHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	s, err := scanStoolRow(db.QueryRow("SELECT "+stoolColumns+" FROM stools WHERE id = ? AND profile_id = ?", id, currentProfileID(r)))
+	if err == sql.ErrNoRows {
+		http.Error(w, "avføring ikke funnet", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "kunne ikke hente avføring", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		BristolOptions []BristolOption
+		UrgencyOptions []string
+		Stool          Stool
+	}{bristolOptions(), urgencyLevels, s}
+	if err := templates.ExecuteTemplate(w, "edit_stool.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// updateStoolHandler processes the stool update form.
+func updateStoolHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	s, err := parseStoolForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = db.Exec("UPDATE stools SET timestamp = ?, tz = ?, bristol = ?, urgency = ?, note = ? WHERE id = ? AND profile_id = ?",
+		s.Timestamp.UTC().Format(time.RFC3339), s.TZ, s.Bristol, s.Urgency, s.Note, r.FormValue("id"), currentProfileID(r))
+	if err != nil {
+		http.Error(w, "feil ved oppdatering", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// deleteStoolHandler deletes a stool entry.
+func deleteStoolHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM stools WHERE id = ? AND profile_id = ?", r.FormValue("id"), currentProfileID(r)); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// queryStoolEvents returns a profile's stools within a UTC date range as
+// outcome impulses for the time series analysis. Loose stools (Bristol 5-7)
+// and hard stools (Bristol 1-2) form separate series, with the distance from
+// the normal range as amplitude.
+func queryStoolEvents(profileID int64, start, end string) (map[string][]seriesEvent, error) {
+	rows, err := db.Query(
+		"SELECT timestamp, bristol FROM stools WHERE profile_id = ? AND DATE(timestamp) BETWEEN ? AND ? ORDER BY timestamp ASC", profileID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make(map[string][]seriesEvent)
+	for rows.Next() {
+		var ts string
+		var bristol int
+		if err := rows.Scan(&ts, &bristol); err != nil {
+			return nil, err
+		}
+		t, err := parseRFC3339(ts)
+		if err != nil {
+			continue
+		}
+		switch {
+		case bristol >= 5:
+			events[looseStoolSeries] = append(events[looseStoolSeries], seriesEvent{Start: t, Value: float64(bristol - 4)})
+		case bristol <= 2:
+			events[hardStoolSeries] = append(events[hardStoolSeries], seriesEvent{Start: t, Value: float64(3 - bristol)})
+		}
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Suggestion kinds
+	suggestMeal    = "meal"
+	suggestSymptom = "symptom"
+
+	// Suggestion preference states
+	prefPinned = "pinned"
+	prefHidden = "hidden"
+
+	// suggestionHalfLifeDays is how quickly old uses lose weight in the ranking
+	suggestionHalfLifeDays = 30.0
+	// suggestionHourWidth is the spread, in hours, of the time-of-day boost:
+	// uses logged near the current time of day count up to three times as much
+	suggestionHourWidth = 2.0
+
+	// Number of names returned by /api/suggest
+	defaultSuggestLimit = 10
+	maxSuggestLimit     = 100
+)
+
+// defaultSymptomOptions are suggested until the user has logged symptoms of
+// their own.
+var defaultSymptomOptions = []string{"Hodepine", "Kvalme", "Tretthet"}
+
+// Suggestion is a previously logged food or symptom name with usage stats.
+type Suggestion struct {
+	Name     string     `json:"name"`
+	Count    int        `json:"count"`
+	LastUsed *time.Time `json:"last_used"`
+	Pinned   bool       `json:"pinned"`
+	Hidden   bool       `json:"-"`
+	Score    float64    `json:"score"`
+}
+
+// suggestionUses returns the name and time of every use of a kind logged by
+// a user.
+func suggestionUses(profileID int64, kind string) (map[string][]time.Time, map[string]string, error) {
+	query := "SELECT description, timestamp FROM symptoms WHERE profile_id = ? AND deleted_at IS NULL"
+	if kind == suggestMeal {
+		query = "SELECT i.name, m.timestamp FROM meal_items i JOIN meals m ON m.id = i.meal_id WHERE m.profile_id = ? AND m.deleted_at IS NULL"
+	}
+	rows, err := db.Query(query+" ORDER BY timestamp ASC", profileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	// Names are merged case-insensitively; the most recent spelling wins
+	uses := make(map[string][]time.Time)
+	spelling := make(map[string]string)
+	for rows.Next() {
+		var name, ts string
+		if err := rows.Scan(&name, &ts); err != nil {
+			return nil, nil, err
+		}
+		t, err := parseRFC3339(ts)
+		if err != nil {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(name))
+		uses[key] = append(uses[key], t)
+		spelling[key] = strings.TrimSpace(name)
+	}
+	return uses, spelling, rows.Err()
+}
+
+// suggestionPrefs returns a profile's pinned/hidden state per lower-cased name.
+func suggestionPrefs(profileID int64, kind string) (map[string]string, map[string]string, error) {
+	rows, err := db.Query("SELECT name, state FROM suggestion_prefs WHERE profile_id = ? AND kind = ?", profileID, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	prefs := make(map[string]string)
+	names := make(map[string]string)
+	for rows.Next() {
+		var name, state string
+		if err := rows.Scan(&name, &state); err != nil {
+			return nil, nil, err
+		}
+		prefs[strings.ToLower(name)] = state
+		names[strings.ToLower(name)] = name
+	}
+	return prefs, names, rows.Err()
+}
+
+// timeOfDayWeight boosts uses logged near the same time of day as now, so
+// that breakfast foods rank high in the morning.
+func timeOfDayWeight(t, now time.Time) float64 {
+	a := float64(t.Local().Hour()) + float64(t.Local().Minute())/60
+	b := float64(now.Hour()) + float64(now.Minute())/60
+	diff := math.Abs(a - b)
+	if diff > 12 {
+		diff = 24 - diff
+	}
+	return 1 + 2*math.Exp(-diff*diff/(2*suggestionHourWidth*suggestionHourWidth))
+}
+
+// rankedSuggestions returns all of a profile's names of a kind, including
+// hidden ones, ranked with pinned names first and the rest by a score that
+// sums every use, weighted by recency and time of day. Extra names, such as catalog
+// foods, are appended with a score of zero if they have never been used.
+func rankedSuggestions(profileID int64, kind string, now time.Time, extra []string) ([]Suggestion, error) {
+	uses, spelling, err := suggestionUses(profileID, kind)
+	if err != nil {
+		return nil, err
+	}
+	prefs, prefNames, err := suggestionPrefs(profileID, kind)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*Suggestion)
+	for key, times := range uses {
+		// Uses are in chronological order, so the last one is the most recent
+		last := times[len(times)-1]
+		s := &Suggestion{Name: spelling[key], Count: len(times), LastUsed: &last}
+		for _, t := range times {
+			ageDays := now.Sub(t).Hours() / 24
+			if ageDays < 0 {
+				ageDays = 0
+			}
+			s.Score += math.Pow(0.5, ageDays/suggestionHalfLifeDays) * timeOfDayWeight(t, now)
+		}
+		byKey[key] = s
+	}
+	// Names with a preference are listed even if they have never been
+	// logged, so that pinned favourites show up and hidden ones can be reset
+	for key, name := range prefNames {
+		if byKey[key] == nil {
+			byKey[key] = &Suggestion{Name: name}
+		}
+	}
+	for _, name := range extra {
+		key := strings.ToLower(name)
+		if byKey[key] == nil {
+			byKey[key] = &Suggestion{Name: name}
+		}
+	}
+	suggestions := make([]Suggestion, 0, len(byKey))
+	for key, s := range byKey {
+		s.Pinned = prefs[key] == prefPinned
+		s.Hidden = prefs[key] == prefHidden
+		suggestions = append(suggestions, *s)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	return suggestions, nil
+}
+
+// visibleSuggestions returns the ranked suggestions offered to the user,
+// without hidden entries. Catalog foods and the default symptoms are included
+// even if they have never been logged.
+func visibleSuggestions(profileID int64, kind string, now time.Time) ([]Suggestion, error) {
+	extra := defaultSymptomOptions
+	if kind == suggestMeal {
+		foods, err := foodNames(profileID)
+		if err != nil {
+			return nil, err
+		}
+		extra = foods
+	}
+	suggestions, err := rankedSuggestions(profileID, kind, now, extra)
+	if err != nil {
+		return nil, err
+	}
+	visible := suggestions[:0]
+	for _, s := range suggestions {
+		if !s.Hidden {
+			visible = append(visible, s)
+		}
+	}
+	return visible, nil
+}
+
+// suggestionNames returns the names to offer in a form's datalist.
+func suggestionNames(profileID int64, kind string) ([]string, error) {
+	suggestions, err := visibleSuggestions(profileID, kind, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range suggestions {
+		names = append(names, s.Name)
+	}
+	return names, nil
+}
+
+// mealOptions returns the food suggestions for meal forms.
+func mealOptions(profileID int64) ([]string, error) {
+	return suggestionNames(profileID, suggestMeal)
+}
+
+// symptomOptions returns the symptom suggestions for symptom forms.
+func symptomOptions(profileID int64) ([]string, error) {
+	return suggestionNames(profileID, suggestSymptom)
+}
+
+// settingsHandler displays the suggestion settings page, where favourites
+// can be pinned and unwanted suggestions hidden.
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	pid, now := currentProfileID(r), time.Now()
+	meals, err := rankedSuggestions(pid, suggestMeal, now, nil)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
+	symptoms, err := rankedSuggestions(pid, suggestSymptom, now, nil)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		MealSuggestions    []Suggestion
+		SymptomSuggestions []Suggestion
+	}{meals, symptoms}
+	if err := templates.ExecuteTemplate(w, "settings.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// suggestionPrefHandler pins, hides or resets a suggestion. An empty state
+// removes the preference.
+func suggestionPrefHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	kind := r.FormValue("kind")
+	name := strings.TrimSpace(r.FormValue("name"))
+	state := r.FormValue("state")
+	if kind != suggestMeal && kind != suggestSymptom {
+		http.Error(w, "ugyldig type", http.StatusBadRequest)
+		return
+	}
+	if name == "" {
+		http.Error(w, "navn må oppgis", http.StatusBadRequest)
+		return
+	}
+	pid := currentProfileID(r)
+	var err error
+	switch state {
+	case "":
+		_, err = db.Exec("DELETE FROM suggestion_prefs WHERE profile_id = ? AND kind = ? AND name = ?", pid, kind, name)
+	case prefPinned, prefHidden:
+		_, err = db.Exec(`INSERT INTO suggestion_prefs (profile_id, kind, name, state) VALUES (?, ?, ?, ?)
+			ON CONFLICT(profile_id, kind, name) DO UPDATE SET state = excluded.state`, pid, kind, name, state)
+	default:
+		http.Error(w, "ugyldig tilstand", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// foldReplacer maps Norwegian and other accented letters to plain ASCII, so
+// that "brod" matches "Brød".
+var foldReplacer = strings.NewReplacer(
+	"æ", "ae", "ø", "o", "å", "a",
+	"ä", "a", "ö", "o", "ü", "u",
+	"é", "e", "è", "e", "ê", "e", "á", "a", "à", "a", "ó", "o", "í", "i", "ú", "u",
+	"ç", "c", "ñ", "n", "ß", "ss",
+)
+
+// foldName lower-cases a name and strips accents for matching.
+func foldName(name string) string {
+	return foldReplacer.Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// matchesPrefix reports whether the name, or any word in it, starts with the
+// folded query.
+func matchesPrefix(name, folded string) bool {
+	for _, word := range strings.Fields(foldName(name)) {
+		if strings.HasPrefix(word, folded) {
+			return true
+		}
+	}
+	return strings.HasPrefix(foldName(name), folded)
+}
+
+// apiSuggestHandler returns ranked food or symptom names for type-ahead.
+// Query parameters: kind (meal or symptom), q (prefix, optional) and limit.
+func apiSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "kun GET er støttet", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	kind := q.Get("kind")
+	if kind != suggestMeal && kind != suggestSymptom {
+		http.Error(w, "kind må være meal eller symptom", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSuggestLimit
+	if v := q.Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > maxSuggestLimit {
+			http.Error(w, "ugyldig limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	suggestions, err := visibleSuggestions(currentProfileID(r), kind, time.Now())
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
+	folded := foldName(q.Get("q"))
+	matches := []Suggestion{}
+	for _, s := range suggestions {
+		if len(matches) == limit {
+			break
+		}
+		if matchesPrefix(s.Name, folded) {
+			matches = append(matches, s)
+		}
+	}
+	if err := writeJSONResponse(w, matches); err != nil {
+		http.Error(w, "feil ved encoding av JSON", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestFoldName(t *testing.T) {
+	cases := []struct{ name, want string }{
+		{"Brød", "brod"},
+		{"Ære", "aere"},
+		{"  Blåbær ", "blabaer"},
+		{"Crème brûlée", "creme brûlee"},
+		{"Jalapeño", "jalapeno"},
+		{"", ""},
+	}
+	for _, c := range cases {
+		if got := foldName(c.name); got != c.want {
+			t.Errorf("foldName(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMatchesPrefix(t *testing.T) {
+	cases := []struct {
+		name, query string
+		want        bool
+	}{
+		{"Brød", "brod", true},
+		{"Brød", "BRØ", true},
+		{"Ærfugl", "aere", false},
+		{"Æresmat", "aere", true},
+		{"Grove brød", "brod", true},
+		{"Grove brød", "rove", false},
+		{"Grove brød", "grove b", true},
+		{"Melk", "melke", false},
+		{"Melk", "", true},
+	}
+	for _, c := range cases {
+		if got := matchesPrefix(c.name, foldName(c.query)); got != c.want {
+			t.Errorf("matchesPrefix(%q, %q) = %v, want %v", c.name, c.query, got, c.want)
+		}
+	}
+}
+
+// useTestDB points the package database at a fresh, migrated one.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	test, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(test); err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = test
+	t.Cleanup(func() {
+		db = saved
+		test.Close()
+	})
+}
+
+func TestAPISuggestLimit(t *testing.T) {
+	useTestDB(t)
+	// A fresh diary suggests only the default symptoms
+	all := len(defaultSymptomOptions)
+	cases := []struct {
+		query  string
+		status int
+		count  int
+	}{
+		{"kind=symptom", http.StatusOK, all},
+		{"kind=symptom&limit=1", http.StatusOK, 1},
+		{"kind=symptom&limit=100", http.StatusOK, all},
+		{"kind=symptom&limit=0", http.StatusBadRequest, 0},
+		{"kind=symptom&limit=101", http.StatusBadRequest, 0},
+		{"kind=symptom&limit=mange", http.StatusBadRequest, 0},
+		{"kind=symptom&q=kval", http.StatusOK, 1},
+		{"kind=symptom&q=ingen", http.StatusOK, 0},
+		{"kind=drink", http.StatusBadRequest, 0},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		apiSuggestHandler(rec, httptest.NewRequest(http.MethodGet, "/api/suggest?"+c.query, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.query, rec.Code, c.status)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		var got []Suggestion
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if len(got) != c.count {
+			t.Errorf("%s: %d suggestions, want %d", c.query, len(got), c.count)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+
+	// Embed the zone database, so that entry zones work on hosts without one
+	_ "time/tzdata"
+)
+
+// zoneOffsetPattern matches fixed UTC offsets such as "+02:00".
+var zoneOffsetPattern = regexp.MustCompile(`^([+-])(\d{2}):(\d{2})$`)
+
+// loadEntryZone returns the location of an IANA zone name or a fixed
+// "+hh:mm" offset. An empty zone is the server's zone, used for entries
+// logged before zones were stored.
+func loadEntryZone(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.Local, nil
+	}
+	if m := zoneOffsetPattern.FindStringSubmatch(tz); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		if hours > 14 || minutes > 59 {
+			return nil, errors.New("ugyldig tidssone")
+		}
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(tz, offset), nil
+	}
+	// "Local" would silently mean the server's zone
+	if tz == "Local" {
+		return nil, errors.New("ugyldig tidssone")
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, errors.New("ugyldig tidssone")
+	}
+	return loc, nil
+}
+
+// entryLocation returns the location of a stored entry zone. Zones that can
+// no longer be loaded fall back to the server's zone.
+func entryLocation(tz string) *time.Location {
+	loc, err := loadEntryZone(tz)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// entryDate returns the calendar date of an entry in the zone it was logged
+// in.
+func entryDate(t time.Time, tz string) string {
+	return t.In(entryLocation(tz)).Format(dateFormat)
+}
+
+// entryDateBounds returns UTC timestamps around the local dates from start to
+// end, inclusive, padded by a day on each side so that they hold every entry
+// on those dates whatever zone it was logged in. Entries are stored in UTC,
+// so queries select by these bounds and narrow to dates with entryDate.
+func entryDateBounds(start, end string) (string, string) {
+	return addDays(start, -1) + "T00:00:00Z", addDays(end, 2) + "T00:00:00Z"
+}
+
+// parseEntryTime parses a wall-clock timestamp from a form or the API in the
+// given zone. Timestamps with an explicit UTC offset (RFC3339) are also
+// accepted; if tz is empty, the offset becomes the entry's zone. It returns
+// the time and the zone to store.
+func parseEntryTime(value, tz string) (time.Time, string, error) {
+	loc, err := loadEntryZone(tz)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if t, err := time.ParseInLocation(timestampFormat, value, loc); err == nil {
+		return t, tz, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, "", errors.New("ugyldig tidspunkt")
+	}
+	if tz == "" {
+		tz = t.Format("-07:00")
+		loc = entryLocation(tz)
+	}
+	return t.In(loc), tz, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEntryTime(t *testing.T) {
+	// Run with a server zone that matches none of the entries, so that any
+	// accidental use of it shows up
+	server, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := time.Local
+	time.Local = server
+	t.Cleanup(func() { time.Local = local })
+
+	cases := []struct {
+		name, value, tz string
+		want            string // UTC instant
+		wantTZ          string
+		wantWall        string // wall clock in the entry's zone
+	}{
+		{"browser zone", "2026-10-16T07:00", "Asia/Tokyo", "2026-10-15T22:00:00Z", "Asia/Tokyo", "2026-10-16T07:00"},
+		{"no zone is the server's", "2026-10-16T07:00", "", "2026-10-16T11:00:00Z", "", "2026-10-16T07:00"},
+		{"fixed offset", "2026-10-16T07:00", "-03:30", "2026-10-16T10:30:00Z", "-03:30", "2026-10-16T07:00"},
+		// 02:30 does not exist in Oslo that night; it lands an hour later
+		{"spring forward gap", "2026-03-29T02:30", "Europe/Oslo", "2026-03-29T01:30:00Z", "Europe/Oslo", "2026-03-29T03:30"},
+		{"offset becomes the zone", "2026-10-16T07:00:00+05:30", "", "2026-10-16T01:30:00Z", "+05:30", "2026-10-16T07:00"},
+		{"offset shown in the given zone", "2026-10-16T07:00:00Z", "Europe/Oslo", "2026-10-16T07:00:00Z", "Europe/Oslo", "2026-10-16T09:00"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, tz, err := parseEntryTime(c.value, c.tz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := got.UTC().Format(time.RFC3339); s != c.want {
+				t.Errorf("time = %s, want %s", s, c.want)
+			}
+			if tz != c.wantTZ {
+				t.Errorf("zone = %q, want %q", tz, c.wantTZ)
+			}
+			if s := got.In(entryLocation(tz)).Format(timestampFormat); s != c.wantWall {
+				t.Errorf("wall clock = %s, want %s", s, c.wantWall)
+			}
+		})
+	}
+}
+
+func TestParseEntryTimeInvalid(t *testing.T) {
+	cases := []struct{ name, value, tz string }{
+		{"server zone by name", "2026-10-16T07:00", "Local"},
+		{"unknown zone", "2026-10-16T07:00", "Mars/Olympus_Mons"},
+		{"offset out of range", "2026-10-16T07:00", "+15:00"},
+		{"minutes out of range", "2026-10-16T07:00", "+01:60"},
+		{"garbage time", "i går", "Europe/Oslo"},
+		{"empty time", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got, _, err := parseEntryTime(c.value, c.tz); err == nil {
+				t.Errorf("parsed %q in %q as %v", c.value, c.tz, got)
+			}
+		})
+	}
+}
+
+func TestEntryDate(t *testing.T) {
+	ts := time.Date(2026, 10, 15, 22, 0, 0, 0, time.UTC)
+	cases := []struct{ tz, want string }{
+		{"Asia/Tokyo", "2026-10-16"},
+		{"America/Los_Angeles", "2026-10-15"},
+		{"+02:00", "2026-10-16"},
+		{"-02:00", "2026-10-15"},
+	}
+	for _, c := range cases {
+		if got := entryDate(ts, c.tz); got != c.want {
+			t.Errorf("entryDate(%v, %q) = %s, want %s", ts, c.tz, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultTrashRetentionDays is how long deleted entries are kept before
+	// they are purged, unless overridden with -trash-retention-days
+	defaultTrashRetentionDays = 30
+	// trashPurgeInterval is how often expired entries are purged
+	trashPurgeInterval = time.Hour
+)
+
+// trashRetentionDays is set from the -trash-retention-days flag. Zero keeps
+// deleted entries until they are purged by hand.
+var trashRetentionDays = defaultTrashRetentionDays
+
+// trashTables are the tables with soft deletion, keyed by entity.
+var trashTables = map[string]string{
+	entityMeal:    "meals",
+	entitySymptom: "symptoms",
+}
+
+// setDeleted moves a profile's entry to the trash, or out of it if deleted is
+// false. It returns sql.ErrNoRows if the entry was not found in the other
+// state.
+func setDeleted(profileID int64, entity string, id interface{}, deleted bool) error {
+	table := trashTables[entity]
+	var res sql.Result
+	var err error
+	if deleted {
+		res, err = db.Exec("UPDATE "+table+" SET deleted_at = ? WHERE id = ? AND profile_id = ? AND deleted_at IS NULL",
+			time.Now().UTC().Format(time.RFC3339), id, profileID)
+	} else {
+		res, err = db.Exec("UPDATE "+table+" SET deleted_at = NULL WHERE id = ? AND profile_id = ? AND deleted_at IS NOT NULL", id, profileID)
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// trashEntry moves an entry to the trash and records the deletion. Entries
+// that are already in the trash are left alone.
+func trashEntry(profileID int64, entity, id, channel string) error {
+	before := entryBefore(profileID, entity, id)
+	err := setDeleted(profileID, entity, id, true)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		recordRevision(profileID, entity, n, revDelete, channel, before)
+	}
+	return nil
+}
+
+// purgeEntries permanently deletes the trashed entries of an entity matching
+// a WHERE clause, with their history. Photo files of purged meals are
+// removed as well.
+func purgeEntries(entity, where string, args ...interface{}) (int64, error) {
+	table := trashTables[entity]
+	where = "deleted_at IS NOT NULL AND " + where
+	var photos []string
+	if entity == entityMeal {
+		rows, err := db.Query("SELECT filename FROM meal_photos WHERE meal_id IN (SELECT id FROM meals WHERE "+where+")", args...)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			photos = append(photos, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+	if err := deleteRevisions(entity, table, where, args...); err != nil {
+		return 0, err
+	}
+	res, err := db.Exec("DELETE FROM "+table+" WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	removePhotoFiles(photos)
+	return res.RowsAffected()
+}
+
+// purgeExpiredTrash permanently deletes entries that have been in the trash
+// longer than the retention period.
+func purgeExpiredTrash() {
+	if trashRetentionDays <= 0 {
+		return
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -trashRetentionDays).Format(time.RFC3339)
+	for entity, table := range trashTables {
+		n, err := purgeEntries(entity, "deleted_at < ?", cutoff)
+		if err != nil {
+			log.Printf("could not purge trash in %s: %v", table, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("purged %d expired entries from %s", n, table)
+		}
+	}
+}
+
+// purgeTrashPeriodically purges expired trash at startup and then at every
+// trashPurgeInterval.
+func purgeTrashPeriodically() {
+	for {
+		purgeExpiredTrash()
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+// trashHandler lists the profile's meals and symptoms in the trash.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	pid := currentProfileID(r)
+	meals, err := queryMeals(pid, "deleted_at IS NOT NULL ORDER BY deleted_at DESC")
+	if err != nil {
+		http.Error(w, "kunne ikke hente måltider", http.StatusInternalServerError)
+		return
+	}
+	symptoms, err := querySymptoms(pid, "deleted_at IS NOT NULL ORDER BY deleted_at DESC")
+	if err != nil {
+		http.Error(w, "kunne ikke hente symptomer", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Meals         []Meal
+		Symptoms      []Symptom
+		RetentionDays int
+	}{meals, symptoms, trashRetentionDays}
+	if err := templates.ExecuteTemplate(w, "trash.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// restoreHandler moves an entry out of the trash.
+func restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return
+	}
+	entity, id := r.FormValue("kind"), r.FormValue("id")
+	if !validEntity(entity) {
+		http.Error(w, "ugyldig type", http.StatusBadRequest)
+		return
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(w, "ugyldig id", http.StatusBadRequest)
+		return
+	}
+	pid := currentProfileID(r)
+	before := entryBefore(pid, entity, n)
+	err = setDeleted(pid, entity, n, false)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "feil ved gjenoppretting", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		recordRevision(pid, entity, n, revRestore, channelWeb, before)
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// purgeHandler permanently deletes one entry from the profile's trash, or all
+// of the profile's trashed entries if no kind is given.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return
+	}
+	pid := currentProfileID(r)
+	kind := r.FormValue("kind")
+	if kind == "" {
+		for entity := range trashTables {
+			if _, err := purgeEntries(entity, "profile_id = ?", pid); err != nil {
+				http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+				return
+			}
+		}
+		http.Redirect(w, r, "/trash", http.StatusSeeOther)
+		return
+	}
+	if !validEntity(kind) {
+		http.Error(w, "ugyldig type", http.StatusBadRequest)
+		return
+	}
+	if _, err := purgeEntries(kind, "profile_id = ? AND id = ?", pid, r.FormValue("id")); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
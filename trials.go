@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Trial arms: the food is eaten on challenge days and avoided on control
+	// days
+	armChallenge = "challenge"
+	armControl   = "control"
+
+	// Trial length in days. Days are randomised in pairs, so the length is
+	// even.
+	defaultTrialDays = 14
+	minTrialDays     = 4
+	maxTrialDays     = 90
+)
+
+// Trial is an N-of-1 challenge trial of one food, following a randomised
+// schedule of challenge and control days. Symptom limits the outcome to one
+// kind of symptom; empty means all symptoms.
+type Trial struct {
+	ID      int64      `json:"id"`
+	Food    string     `json:"food"`
+	Symptom string     `json:"symptom"`
+	Days    []TrialDay `json:"days"`
+}
+
+// TrialDay is a day of a trial and the arm it was assigned to.
+type TrialDay struct {
+	Date string `json:"date"`
+	Arm  string `json:"arm"`
+}
+
+// Challenge reports whether the food is to be eaten on the day.
+func (d TrialDay) Challenge() bool {
+	return d.Arm == armChallenge
+}
+
+// StartDate returns the first day of the trial.
+func (t Trial) StartDate() string {
+	if len(t.Days) == 0 {
+		return ""
+	}
+	return t.Days[0].Date
+}
+
+// EndDate returns the last day of the trial.
+func (t Trial) EndDate() string {
+	if len(t.Days) == 0 {
+		return ""
+	}
+	return t.Days[len(t.Days)-1].Date
+}
+
+// Today returns today's day of the trial, or nil if it is not running.
+func (t Trial) Today() *TrialDay {
+	today := time.Now().Format(dateFormat)
+	for i, d := range t.Days {
+		if d.Date == today {
+			return &t.Days[i]
+		}
+	}
+	return nil
+}
+
+// trialSchedule assigns the days from start to the two arms, randomising the
+// order within each pair of days. Pairing keeps the arms balanced and spread
+// over the whole trial, so that slow changes in symptoms affect both alike.
+func trialSchedule(start string, days int, rng *rand.Rand) []TrialDay {
+	schedule := make([]TrialDay, 0, days)
+	for i := 0; i+1 < days; i += 2 {
+		first, second := armChallenge, armControl
+		if rng.Intn(2) == 0 {
+			first, second = second, first
+		}
+		schedule = append(schedule,
+			TrialDay{Date: addDays(start, i), Arm: first},
+			TrialDay{Date: addDays(start, i+1), Arm: second})
+	}
+	return schedule
+}
+
+// getTrials returns a profile's trials with their schedules, latest start
+// first.
+func getTrials(profileID int64) ([]Trial, error) {
+	rows, err := db.Query(`SELECT t.id, t.food, t.symptom, d.date, d.arm FROM trials t
+		JOIN trial_days d ON d.trial_id = t.id WHERE t.profile_id = ?
+		ORDER BY (SELECT MIN(date) FROM trial_days WHERE trial_id = t.id) DESC, t.id DESC, d.date`, profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var trials []Trial
+	for rows.Next() {
+		var t Trial
+		var d TrialDay
+		if err := rows.Scan(&t.ID, &t.Food, &t.Symptom, &d.Date, &d.Arm); err != nil {
+			return nil, err
+		}
+		if n := len(trials); n == 0 || trials[n-1].ID != t.ID {
+			trials = append(trials, t)
+		}
+		trials[len(trials)-1].Days = append(trials[len(trials)-1].Days, d)
+	}
+	return trials, rows.Err()
+}
+
+// saveTrial stores a new trial with its schedule for a profile.
+func saveTrial(profileID int64, t Trial) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("INSERT INTO trials (profile_id, food, symptom, created_at) VALUES (?, ?, ?, ?)",
+		profileID, t.Food, t.Symptom, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, d := range t.Days {
+		if _, err := tx.Exec("INSERT INTO trial_days (trial_id, date, arm) VALUES (?, ?, ?)", id, d.Date, d.Arm); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// parseTrialForm reads a new trial from the form and draws its schedule.
+func parseTrialForm(r *http.Request) (Trial, error) {
+	t := Trial{Food: strings.TrimSpace(r.FormValue("food")), Symptom: strings.TrimSpace(r.FormValue("symptom"))}
+	if t.Food == "" {
+		return t, errors.New("matvare må oppgis")
+	}
+	start := r.FormValue("start_date")
+	if _, err := parseDateOnly(start); err != nil {
+		return t, errors.New("ugyldig startdato")
+	}
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < minTrialDays || days > maxTrialDays || days%2 != 0 {
+		return t, errors.New("antall dager må være et partall mellom 4 og 90")
+	}
+	t.Days = trialSchedule(start, days, rand.New(rand.NewSource(time.Now().UnixNano())))
+	return t, nil
+}
+
+// TrialOutcome compares a daily symptom measure between the arms of a
+// trial.
+type TrialOutcome struct {
+	Label         string
+	ChallengeMean float64
+	ControlMean   float64
+	// PValue is from a permutation test of the difference in means
+	PValue float64
+	// CohensD is the effect size, valid only if HasEffectSize is set
+	CohensD       float64
+	HasEffectSize bool
+}
+
+// Difference returns the mean on challenge days minus the mean on control
+// days.
+func (o TrialOutcome) Difference() float64 {
+	return o.ChallengeMean - o.ControlMean
+}
+
+// TrialReport is a trial with its adherence so far and, once it has ended,
+// its outcomes.
+type TrialReport struct {
+	Trial
+	// Status is "planned", "ongoing" or "done"
+	Status string
+	// Adherent holds, for each day that is over, whether the food was eaten
+	// on challenge days and avoided on control days
+	Adherent           map[string]bool
+	ChallengeAdherent  int
+	ChallengeElapsed   int
+	ControlAdherent    int
+	ControlElapsed     int
+	Outcomes           []TrialOutcome
+	SignificanceLevel  float64
+	SignificantOutcome bool
+}
+
+// trialReport evaluates a trial from a profile's meals and symptoms. The
+// outcomes compare days by their assigned arm, whether or not the schedule
+// was followed, which keeps the comparison randomised; adherence is reported
+// alongside so that it can be judged.
+func trialReport(profileID int64, t Trial, group foodGrouper) (TrialReport, error) {
+	rep := TrialReport{Trial: t, Status: "done", Adherent: make(map[string]bool), SignificanceLevel: 0.05}
+	today := time.Now().Format(dateFormat)
+	if t.StartDate() > today {
+		rep.Status = "planned"
+		return rep, nil
+	}
+	if t.EndDate() >= today {
+		rep.Status = "ongoing"
+	}
+
+	from, to := entryDateBounds(t.StartDate(), t.EndDate())
+	meals, err := queryMeals(profileID, "deleted_at IS NULL AND timestamp >= ? AND timestamp < ?", from, to)
+	if err != nil {
+		return rep, err
+	}
+	symptoms, err := querySymptoms(profileID, "deleted_at IS NULL AND timestamp >= ? AND timestamp < ?", from, to)
+	if err != nil {
+		return rep, err
+	}
+
+	eaten := make(map[string]bool)
+	for _, m := range meals {
+		for _, item := range m.Items {
+			if containsFood([]string{t.Food}, group(item.Name)) {
+				eaten[m.Timestamp.Format(dateFormat)] = true
+			}
+		}
+	}
+	count := make(map[string]float64)
+	worst := make(map[string]float64)
+	for _, s := range symptoms {
+		if t.Symptom != "" && !strings.EqualFold(s.Description, t.Symptom) {
+			continue
+		}
+		d := s.Timestamp.Format(dateFormat)
+		count[d]++
+		if float64(s.Severity) > worst[d] {
+			worst[d] = float64(s.Severity)
+		}
+	}
+
+	// Today is left out until it is over
+	for _, d := range t.Days {
+		if d.Date >= today {
+			break
+		}
+		adherent := eaten[d.Date] == d.Challenge()
+		rep.Adherent[d.Date] = adherent
+		if d.Challenge() {
+			rep.ChallengeElapsed++
+			if adherent {
+				rep.ChallengeAdherent++
+			}
+		} else {
+			rep.ControlElapsed++
+			if adherent {
+				rep.ControlAdherent++
+			}
+		}
+	}
+	if rep.Status != "done" {
+		return rep, nil
+	}
+
+	// The permutation test uses a fixed seed per trial, so that a report
+	// shows the same p-value every time it is opened
+	rng := rand.New(rand.NewSource(t.ID))
+	for _, measure := range []struct {
+		label  string
+		values map[string]float64
+	}{
+		{"Antall symptomer per dag", count},
+		{"Høyeste alvorlighet per dag", worst},
+	} {
+		var pairs [][2]float64
+		var challenge, control []float64
+		for i := 0; i+1 < len(t.Days); i += 2 {
+			a, b := t.Days[i], t.Days[i+1]
+			if !a.Challenge() {
+				a, b = b, a
+			}
+			va, vb := measure.values[a.Date], measure.values[b.Date]
+			pairs = append(pairs, [2]float64{va, vb})
+			challenge = append(challenge, va)
+			control = append(control, vb)
+		}
+		o := TrialOutcome{Label: measure.label, ChallengeMean: mean(challenge), ControlMean: mean(control)}
+		o.PValue = pairPermutationTest(pairs, rng)
+		o.CohensD, o.HasEffectSize = cohensD(challenge, control)
+		if o.PValue < rep.SignificanceLevel {
+			rep.SignificantOutcome = true
+		}
+		rep.Outcomes = append(rep.Outcomes, o)
+	}
+	return rep, nil
+}
+
+// activeTrials returns the trials that are running today.
+func activeTrials(trials []Trial) []Trial {
+	var active []Trial
+	for _, t := range trials {
+		if t.Today() != nil {
+			active = append(active, t)
+		}
+	}
+	return active
+}
+
+// trialsHandler shows the profile's trials with adherence and results and,
+// on POST, plans a new trial.
+func trialsHandler(w http.ResponseWriter, r *http.Request) {
+	pid := currentProfileID(r)
+	if r.Method == http.MethodPost {
+		t, err := parseTrialForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveTrial(pid, t); err != nil {
+			http.Error(w, "feil ved lagring", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/trials", http.StatusSeeOther)
+		return
+	}
+	trials, err := getTrials(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forsøk", http.StatusInternalServerError)
+		return
+	}
+	foods, err := getAllFoods(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente matvarer", http.StatusInternalServerError)
+		return
+	}
+	group := treeGrouper(newFoodTree(foods), -1)
+	var reports []TrialReport
+	for _, t := range trials {
+		rep, err := trialReport(pid, t, group)
+		if err != nil {
+			http.Error(w, "kunne ikke beregne resultater", http.StatusInternalServerError)
+			return
+		}
+		reports = append(reports, rep)
+	}
+	mealOptions, err := mealOptions(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
+	symptomOptions, err := symptomOptions(pid)
+	if err != nil {
+		http.Error(w, "kunne ikke hente forslag", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Reports        []TrialReport
+		MealOptions    []string
+		SymptomOptions []string
+		Today          string
+		Days           int
+	}{reports, mealOptions, symptomOptions, time.Now().Format(dateFormat), defaultTrialDays}
+	if err := templates.ExecuteTemplate(w, "trials.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// deleteTrialHandler deletes a trial. Logged entries are kept.
+func deleteTrialHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/trials", http.StatusSeeOther)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM trials WHERE id = ? AND profile_id = ?", r.FormValue("id"), currentProfileID(r)); err != nil {
+		http.Error(w, "feil ved sletting", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/trials", http.StatusSeeOther)
+}